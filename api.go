@@ -17,21 +17,23 @@ type Response struct {
 }
 
 type ResponseEasy struct {
-	Ok  bool   `json:"ok"`
-	Pin string `json:"pin"`
+	Ok       bool     `json:"ok"`
+	Pin      string   `json:"pin"`
+	Warnings []string `json:"warnings,omitempty"`
 }
 
 type SuccessClaim struct {
-	Name    string `json:"name"`
-	Domain  string `json:"domain"`
-	PIN     string `json:"pin"`
-	Invoice string `json:"invoice"`
+	Name     string   `json:"name"`
+	Domain   string   `json:"domain"`
+	PIN      string   `json:"pin"`
+	Invoice  string   `json:"invoice"`
+	Warnings []string `json:"warnings,omitempty"`
 }
 
 // not authenticated, if correct pin is provided call returns the SuccessClaim
 func ClaimAddress(w http.ResponseWriter, r *http.Request) {
 	params := parseParams(r)
-	pin, inv, err := SaveName(params.Name, params.Domain, params, params.Pin, false, "")
+	pin, inv, warnings, err := SaveName(params.Name, params.Domain, params, params.Pin, false, "")
 	if err != nil {
 		sendError(w, 400, "could not register name: %s", err.Error())
 		return
@@ -40,7 +42,7 @@ func ClaimAddress(w http.ResponseWriter, r *http.Request) {
 	response := Response{
 		Ok:      true,
 		Message: fmt.Sprintf("claimed %v@%v", params.Name, params.Domain),
-		Data:    SuccessClaim{params.Name, params.Domain, pin, inv},
+		Data:    SuccessClaim{params.Name, params.Domain, pin, inv, warnings},
 	}
 
 	// TODO: middleware for responses that adds this header
@@ -83,7 +85,8 @@ func UpdateUser(w http.ResponseWriter, r *http.Request) {
 		params.Pin = r.Header.Get("X-Pin")
 	}
 
-	if _, _, err := SaveName(name, domain, params, params.Pin, false, ""); err != nil {
+	_, _, warnings, err := SaveName(name, domain, params, params.Pin, false, "")
+	if err != nil {
 		sendError(w, 500, err.Error())
 		return
 	}
@@ -100,6 +103,9 @@ func UpdateUser(w http.ResponseWriter, r *http.Request) {
 		Message: fmt.Sprintf("updated %v@%v parameters", params.Name, domain),
 		Data:    updatedParams,
 	}
+	if len(warnings) > 0 {
+		response.Message += ", but " + strings.Join(warnings, ", ")
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
@@ -109,6 +115,16 @@ func UpdateUser(w http.ResponseWriter, r *http.Request) {
 func DeleteUser(w http.ResponseWriter, r *http.Request) {
 	name := mux.Vars(r)["name"]
 	domain := mux.Vars(r)["domain"]
+
+	// the ecash is stored under the name, whoever takes it next would get it
+	if balance, err := CashuBalance(getID(name, domain)); err != nil {
+		sendError(w, 500, err.Error())
+		return
+	} else if balance > 0 {
+		sendError(w, 409, "%v@%v still has %d sat of ecash, redeem it first", name, domain, balance)
+		return
+	}
+
 	if err := DeleteName(name, domain); err != nil {
 		sendError(w, 500, err.Error())
 		return
@@ -186,3 +202,59 @@ func parseParams(r *http.Request) *Params {
 	jsoniter.Unmarshal(reqBody, &params)
 	return &params
 }
+
+func GetCashuBalance(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	domain := mux.Vars(r)["domain"]
+	balance, err := CashuBalance(getID(name, domain))
+	if err != nil {
+		sendError(w, 500, err.Error())
+		return
+	}
+
+	response := Response{
+		Ok:      true,
+		Message: fmt.Sprintf("%v@%v has %d sat of ecash", name, domain, balance),
+		Data:    map[string]int64{"balance": balance},
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	jsoniter.NewEncoder(w).Encode(response)
+}
+
+// RedeemCashu hands out all ecash received by a cashu address as a token and
+// forgets it, so it can only be redeemed once.
+func RedeemCashu(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	domain := mux.Vars(r)["domain"]
+	stored, err := TakeCashuProofs(getID(name, domain))
+	if err != nil {
+		sendError(w, 500, err.Error())
+		return
+	}
+	if len(stored) == 0 {
+		sendError(w, 404, "no ecash to redeem for %v@%v", name, domain)
+		return
+	}
+
+	token, err := encodeCashuToken(stored)
+	if err != nil {
+		// put them back rather than losing them
+		for _, mint := range stored {
+			AddCashuProofs(getID(name, domain), mint.Mint, mint.Proofs)
+		}
+		sendError(w, 500, err.Error())
+		return
+	}
+
+	response := Response{
+		Ok:      true,
+		Message: fmt.Sprintf("redeemed ecash of %v@%v", name, domain),
+		Data:    map[string]string{"token": token},
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	jsoniter.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// BackendParams is implemented by every wallet kind an address can be backed by.
+// Adding a new wallet means implementing this interface on one type and
+// registering a constructor for it with registerBackendKind.
+type BackendParams interface {
+	getCert() string
+	isTor() bool
+
+	// MakeInvoice creates a bolt11 invoice on the wallet.
+	MakeInvoice(params LNParams) (bolt11 string, err error)
+
+	// LookupInvoice returns the settlement status of the invoice with the given payment hash.
+	LookupInvoice(paymentHash string) (InvoiceStatus, error)
+
+	// Capabilities describes what the wallet supports.
+	Capabilities() Capabilities
+
+	// Health checks whether the wallet can be reached with the given credentials.
+	Health() error
+}
+
+// InvoiceSubscriber is implemented by backends that can push settlement events
+// instead of being polled with LookupInvoice.
+type InvoiceSubscriber interface {
+	// WaitInvoice blocks until the invoice with the given payment hash is paid,
+	// the context is done or the subscription fails.
+	WaitInvoice(ctx context.Context, paymentHash string) (InvoiceStatus, error)
+}
+
+// InvoiceReferrer is implemented by backends that look invoices up by an id
+// of their own rather than by payment hash. The id is stored with the pending
+// invoice, so lookups keep working after a restart.
+type InvoiceReferrer interface {
+	// MakeInvoiceRef is MakeInvoice also returning the wallet's id for the invoice.
+	MakeInvoiceRef(params LNParams) (bolt11 string, ref string, err error)
+
+	// LookupInvoiceRef is LookupInvoice for the invoice with the given id.
+	LookupInvoiceRef(paymentHash string, ref string) (InvoiceStatus, error)
+}
+
+type InvoiceStatus struct {
+	Paid             bool
+	PaidAt           time.Time
+	MSatoshiReceived int64
+}
+
+type Capabilities struct {
+	// the wallet can commit to a description_hash instead of a plain description,
+	// which is required for LNURL-pay and NIP-57
+	DescriptionHash bool
+
+	// the wallet can report whether an invoice has been paid
+	InvoiceLookup bool
+
+	// invoice amounts must be multiples of this many msat, e.g. 1000 for
+	// wallets that only take whole satoshis, 0 means any amount
+	MsatoshiStep int64
+}
+
+// amountStep returns the msat granularity of invoice amounts, at least 1.
+func (c Capabilities) amountStep() int64 {
+	if c.MsatoshiStep > 1 {
+		return c.MsatoshiStep
+	}
+	return 1
+}
+
+// capabilities returns what all backends an address may issue invoices with
+// support, since any of them can end up serving a payment.
+func (params *Params) capabilities() Capabilities {
+	combined := Capabilities{
+		DescriptionHash: true,
+		InvoiceLookup:   true,
+	}
+
+	found := false
+	for index, config := range params.backendConfigs() {
+		// the pool itself can't issue invoices, only its members
+		if index == 0 && params.Kind == "pool" {
+			continue
+		}
+		backend, err := backendFromParams(config)
+		if err != nil {
+			continue
+		}
+		found = true
+
+		capabilities := backend.Capabilities()
+		combined.DescriptionHash = combined.DescriptionHash && capabilities.DescriptionHash
+		combined.InvoiceLookup = combined.InvoiceLookup && capabilities.InvoiceLookup
+		if capabilities.amountStep() > combined.amountStep() {
+			combined.MsatoshiStep = capabilities.MsatoshiStep
+		}
+	}
+	if !found {
+		return Capabilities{}
+	}
+	return combined
+}
+
+var errLookupUnsupported = errors.New("invoice lookup is not supported by this backend")
+
+// errWrongPassword is returned by backends whose api rejected the configured password.
+var errWrongPassword = errors.New("the backend rejected the password")
+
+var backendKinds = map[string]func(params *Params) BackendParams{}
+
+func registerBackendKind(kind string, constructor func(params *Params) BackendParams) {
+	if _, exists := backendKinds[kind]; exists {
+		panic("backend kind registered twice: " + kind)
+	}
+	backendKinds[kind] = constructor
+}
+
+func backendFromParams(params *Params) (BackendParams, error) {
+	constructor, ok := backendKinds[params.Kind]
+	if !ok {
+		return nil, fmt.Errorf("unknown backend kind '%s'", params.Kind)
+	}
+	return constructor(params), nil
+}
+
+// backendConfigs returns the backend configurations of an address in order of
+// preference: its own fields first, then the entries of Backends.
+func (params *Params) backendConfigs() []*Params {
+	configs := []*Params{params}
+	for i := range params.Backends {
+		config := params.Backends[i]
+		config.Name = params.Name
+		config.Domain = params.Domain
+		configs = append(configs, &config)
+	}
+	return configs
+}
+
+// backendAt returns the backend with the given index in backendConfigs.
+func backendAt(params *Params, index int) (BackendParams, error) {
+	configs := params.backendConfigs()
+	if index < 0 || index >= len(configs) {
+		return nil, fmt.Errorf("%s@%s has no backend %d", params.Name, params.Domain, index)
+	}
+	return backendFromParams(configs[index])
+}
+
+// backendID identifies a backend by its whole configuration. Pending invoices
+// keep it, so they are never looked up on another backend after the backends
+// of an address were edited.
+func backendID(backend BackendParams) string {
+	sum := sha256.Sum256([]byte(backendKey(backend)))
+	return hex.EncodeToString(sum[:8])
+}
+
+// issuingBackend returns the backend of params with the given id, trying the
+// one at index first. Invoices stored without an id only have the index.
+func issuingBackend(params *Params, index int, id string) (BackendParams, error) {
+	if id == "" {
+		return backendAt(params, index)
+	}
+
+	if backend, err := backendAt(params, index); err == nil && backendID(backend) == id {
+		return backend, nil
+	}
+	for _, config := range params.backendConfigs() {
+		if backend, err := backendFromParams(config); err == nil && backendID(backend) == id {
+			return backend, nil
+		}
+	}
+	return nil, fmt.Errorf("the backend that issued the invoice is no longer configured for %s@%s", params.Name, params.Domain)
+}
+
+// LookupInvoice looks up an invoice by the id its backend gave it, if any, or
+// else by payment hash.
+func LookupInvoice(backend BackendParams, paymentHash string, ref string) (InvoiceStatus, error) {
+	if !backend.Capabilities().InvoiceLookup {
+		return InvoiceStatus{}, errLookupUnsupported
+	}
+
+	if referrer, ok := backend.(InvoiceReferrer); ok && ref != "" {
+		return referrer.LookupInvoiceRef(paymentHash, ref)
+	}
+	return backend.LookupInvoice(paymentHash)
+}
+
+func CheckHealth(backend BackendParams) error {
+	return backend.Health()
+}
+
+// healthCheckTimeout bounds health checks of backends without a timeout of
+// their own, so saving an address answers before the server's write timeout.
+const healthCheckTimeout = 10 * time.Second
+
+// checkHealthWithin is CheckHealth giving up after timeout, or after
+// healthCheckTimeout if none is set.
+func checkHealthWithin(backend BackendParams, timeout time.Duration) error {
+	if timeout <= 0 {
+		timeout = healthCheckTimeout
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- CheckHealth(backend) }()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("backend didn't respond within %s", timeout)
+	}
+}
+
+type backendClientKey struct {
+	cert       [32]byte // hash of the PEM, zero for none
+	selfSigned bool
+	tor        bool
+	timeout    time.Duration
+}
+
+// backendClients holds an *http.Client per backendClientKey, so backends with
+// the same TLS and proxy settings share pooled connections, and calls for
+// different backends never touch each other's configuration.
+var backendClients sync.Map
+
+// clientFor returns the http client to talk to the given backend with.
+func clientFor(backend BackendParams) *http.Client {
+	return cachedClient(backend, ClientTimeout)
+}
+
+// streamingClient returns a client for long-lived requests to the backend.
+// It has no timeout of its own, so requests must be bound by a context.
+func streamingClient(backend BackendParams) *http.Client {
+	return cachedClient(backend, 0)
+}
+
+// publicClient is used for backends at user-given urls that aren't onions,
+// like forward targets and custom wallets. It verifies certificates, and it
+// refuses to connect to anything but public addresses, whatever a name
+// resolves to and wherever a redirect leads.
+var (
+	publicClientOnce sync.Once
+	publicClient     *http.Client
+)
+
+// publicClientFor returns publicClient, or the tor client for onion backends.
+func publicClientFor(backend BackendParams) *http.Client {
+	if backend.isTor() {
+		return clientFor(backend)
+	}
+	return getPublicClient()
+}
+
+func getPublicClient() *http.Client {
+	publicClientOnce.Do(func() {
+		dialer := &net.Dialer{Control: refuseNonPublicAddress}
+		publicClient = &http.Client{
+			Timeout:   ClientTimeout,
+			Transport: &http.Transport{DialContext: dialer.DialContext},
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) >= 10 {
+					return errors.New("too many redirects")
+				}
+				return checkPublicURL(req.URL.String())
+			},
+		}
+	})
+	return publicClient
+}
+
+func refuseNonPublicAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() {
+		return fmt.Errorf("%s is not a public address", host)
+	}
+	return nil
+}
+
+// checkPublicURL refuses urls that don't use https (plain http is fine for
+// onions) and urls on our own domains, which could call back into the
+// address they are called for.
+func checkPublicURL(target string) error {
+	u, err := url.Parse(target)
+	if err != nil {
+		return fmt.Errorf("invalid url: %w", err)
+	}
+	if u.Scheme != "https" && !(u.Scheme == "http" && strings.HasSuffix(u.Hostname(), ".onion")) {
+		return fmt.Errorf("%s doesn't use https", target)
+	}
+	for _, one := range getDomains(s.Domain) {
+		if strings.EqualFold(u.Hostname(), one) {
+			return fmt.Errorf("%s is served by this server", one)
+		}
+	}
+	return nil
+}
+
+func cachedClient(backend BackendParams, timeout time.Duration) *http.Client {
+	key := backendClientKey{
+		selfSigned: selfSignedByDefault(backend),
+		tor:        backend.isTor(),
+		timeout:    timeout,
+	}
+	if backend.getCert() != "" {
+		key.cert = sha256.Sum256([]byte(backend.getCert()))
+	}
+
+	if client, ok := backendClients.Load(key); ok {
+		return client.(*http.Client)
+	}
+
+	client, _ := backendClients.LoadOrStore(key, &http.Client{
+		Timeout:   timeout,
+		Transport: backendTransport(backend),
+	})
+	return client.(*http.Client)
+}
+
+func backendTransport(backend BackendParams) *http.Transport {
+	specialTransport := &http.Transport{}
+
+	// verify against the given cert, not at all for nodes without one, or against the system roots
+	if backend.getCert() != "" {
+		tlsConfig, err := certTLSConfig(backend.getCert())
+		if err != nil {
+			// certs are validated when saved, but never fall back to not verifying
+			tlsConfig = &tls.Config{
+				InsecureSkipVerify: true,
+				VerifyPeerCertificate: func([][]byte, [][]*x509.Certificate) error {
+					return err
+				},
+			}
+		}
+		specialTransport.TLSClientConfig = tlsConfig
+	} else if selfSignedByDefault(backend) {
+		specialTransport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	// use a tor proxy?
+	if backend.isTor() {
+		torURL, _ := url.Parse(TorProxyURL)
+		specialTransport.Proxy = http.ProxyURL(torURL)
+	}
+
+	return specialTransport
+}
+
+// selfSignedByDefault tells whether a backend is a self-hosted node, which
+// usually comes with a self-signed cert and isn't verified unless a cert is
+// given. Hosted services are always verified against the system roots.
+func selfSignedByDefault(backend BackendParams) bool {
+	switch backend.(type) {
+	case LNDParams, SparkoParams, LNBitsParams, EclairParams, PhoenixdParams:
+		return true
+	}
+	return false
+}
+
+// certTLSConfig verifies servers against cert, which is either a PEM
+// certificate (or CA) or the hex sha256 fingerprint of the server's
+// certificate, with or without colons, to pin.
+func certTLSConfig(cert string) (*tls.Config, error) {
+	if strings.Contains(cert, "-----BEGIN") {
+		caCertPool := x509.NewCertPool()
+		if !caCertPool.AppendCertsFromPEM([]byte(cert)) {
+			return nil, errors.New("no valid certificate found in the given PEM")
+		}
+		return &tls.Config{RootCAs: caCertPool}, nil
+	}
+
+	// accept openssl's "sha256 Fingerprint=AB:CD:..." output as it is
+	if i := strings.LastIndex(cert, "="); i != -1 {
+		cert = cert[i+1:]
+	}
+	fingerprint, err := hex.DecodeString(strings.NewReplacer(":", "", " ", "").Replace(strings.TrimSpace(cert)))
+	if err != nil || len(fingerprint) != sha256.Size {
+		return nil, errors.New("cert must be a PEM certificate or a hex sha256 fingerprint")
+	}
+	return &tls.Config{
+		// the chain isn't checked, only that the server presents the pinned cert
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("server presented no certificate")
+			}
+			if sum := sha256.Sum256(rawCerts[0]); subtle.ConstantTimeCompare(sum[:], fingerprint) != 1 {
+				return fmt.Errorf("server certificate fingerprint %x doesn't match the pinned one", sum)
+			}
+			return nil
+		},
+	}, nil
+}
+
+// clnMsat parses a millisatoshi amount that c-lightning reports either as a
+// plain number or as a string with an "msat" suffix, depending on its version.
+func clnMsat(amount gjson.Result) int64 {
+	msat, _ := strconv.ParseInt(strings.TrimSuffix(amount.String(), "msat"), 10, 64)
+	return msat
+}
+
+// clnInvoiceStatus reads the status of an invoice object as returned by
+// c-lightning's listinvoices and waitinvoice.
+func clnInvoiceStatus(invoice gjson.Result) InvoiceStatus {
+	if invoice.Get("status").String() != "paid" {
+		return InvoiceStatus{}
+	}
+	return InvoiceStatus{
+		Paid:             true,
+		PaidAt:           time.Unix(invoice.Get("paid_at").Int(), 0),
+		MSatoshiReceived: clnMsat(invoice.Get("amount_received_msat")),
+	}
+}
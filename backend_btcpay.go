@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+func init() {
+	registerBackendKind("btcpay", func(params *Params) BackendParams {
+		return BTCPayParams{
+			Host:    strings.TrimSuffix(params.Host, "/"),
+			Key:     params.Key,
+			StoreId: params.StoreId,
+			Cert:    params.Cert,
+		}
+	})
+}
+
+// BTCPayParams uses the lightning node of a BTCPay Server store through the
+// Greenfield API. The api key needs the store's lightning invoice permissions.
+type BTCPayParams struct {
+	Cert    string
+	Host    string
+	Key     string
+	StoreId string
+}
+
+func (l BTCPayParams) getCert() string { return l.Cert }
+func (l BTCPayParams) isTor() bool {
+	return strings.Contains(l.Host, ".onion")
+}
+
+func (l BTCPayParams) Capabilities() Capabilities {
+	return Capabilities{
+		DescriptionHash: true,
+		InvoiceLookup:   true,
+	}
+}
+
+func (l BTCPayParams) request(method, path string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method,
+		l.Host+"/api/v1/stores/"+url.PathEscape(l.StoreId)+"/lightning/BTC"+path, body)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Authorization", "token "+l.Key)
+	req.Header.Set("Content-Type", "application/json")
+	return clientFor(l).Do(req)
+}
+
+func (l BTCPayParams) call(method, path string, body io.Reader) ([]byte, error) {
+	resp, err := l.request(method, path, body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("call to btcpay failed (%d): %s", resp.StatusCode, responseErrorText(resp))
+	}
+
+	return io.ReadAll(resp.Body)
+}
+
+func (l BTCPayParams) MakeInvoice(params LNParams) (bolt11 string, err error) {
+	bolt11, _, err = l.MakeInvoiceRef(params)
+	return bolt11, err
+}
+
+// MakeInvoiceRef returns the greenfield invoice id along with the bolt11. It
+// is the payment hash on LND but not on every node type.
+func (l BTCPayParams) MakeInvoiceRef(params LNParams) (bolt11 string, ref string, err error) {
+	// amounts are strings of millisatoshis
+	body, _ := sjson.Set("{}", "amount", strconv.FormatInt(params.Msatoshi, 10))
+	body, _ = sjson.Set(body, "description", params.Description)
+	body, _ = sjson.Set(body, "descriptionHashOnly", params.UseDescriptionHash)
+	body, _ = sjson.Set(body, "privateRouteHints", s.LNDprivateOnly)
+
+	b, err := l.call("POST", "/invoices", bytes.NewBuffer([]byte(body)))
+	if err != nil {
+		return "", "", err
+	}
+
+	invoice := gjson.ParseBytes(b)
+	bolt11 = invoice.Get("BOLT11").String()
+	if bolt11 == "" {
+		return "", "", fmt.Errorf("no BOLT11 found in btcpay response, got %s", string(b))
+	}
+
+	return bolt11, invoice.Get("id").String(), nil
+}
+
+// LookupInvoice is only used for invoices stored without their greenfield id,
+// which are found if their id is the payment hash.
+func (l BTCPayParams) LookupInvoice(paymentHash string) (InvoiceStatus, error) {
+	return l.LookupInvoiceRef(paymentHash, paymentHash)
+}
+
+func (l BTCPayParams) LookupInvoiceRef(paymentHash string, ref string) (InvoiceStatus, error) {
+	b, err := l.call("GET", "/invoices/"+url.PathEscape(ref), nil)
+	if err != nil {
+		return InvoiceStatus{}, err
+	}
+
+	invoice := gjson.ParseBytes(b)
+	if invoice.Get("status").String() != "Paid" {
+		return InvoiceStatus{}, nil
+	}
+
+	status := InvoiceStatus{
+		Paid:             true,
+		PaidAt:           time.Now(),
+		MSatoshiReceived: invoice.Get("amountReceived").Int(),
+	}
+	if paidAt := invoice.Get("paidAt").Int(); paidAt != 0 {
+		status.PaidAt = time.Unix(paidAt, 0)
+	}
+	return status, nil
+}
+
+// Health looks up an invoice that doesn't exist. Unlike the node info, that
+// only needs the invoice permissions of the api key, and "not found" shows
+// both the key and the node work.
+func (l BTCPayParams) Health() error {
+	var hash [32]byte
+	if _, err := rand.Read(hash[:]); err != nil {
+		return err
+	}
+
+	resp, err := l.request("GET", "/invoices/"+hex.EncodeToString(hash[:]), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound && resp.StatusCode >= 300 {
+		return fmt.Errorf("call to btcpay failed (%d): %s", resp.StatusCode, responseErrorText(resp))
+	}
+	return nil
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	jsoniter "github.com/json-iterator/go"
+	decodepay "github.com/nbd-wtf/ln-decodepay"
+	"github.com/tidwall/gjson"
+)
+
+func init() {
+	registerBackendKind("cashu", func(params *Params) BackendParams {
+		return CashuParams{
+			Mint:  strings.TrimSuffix(params.Mint, "/"),
+			Owner: getID(params.Name, params.Domain),
+			Cert:  params.Cert,
+		}
+	})
+}
+
+// CashuParams receives into a cashu mint: invoices are mint quotes (NUT-04)
+// and once one is paid we mint the ecash and keep it in cashuDb until the
+// owner redeems it through the api.
+// Mints are hosted services, so their TLS is always verified, against Cert if
+// one is given and the system roots otherwise.
+type CashuParams struct {
+	Mint  string
+	Owner string
+	Cert  string
+}
+
+// minting must happen once per quote, even if a subscription and a poll race
+type cashuQuoteLock struct {
+	sync.Mutex
+	users int
+}
+
+var (
+	cashuQuoteLocksMu sync.Mutex
+	cashuQuoteLocks   = make(map[string]*cashuQuoteLock) // by payment hash
+)
+
+// lockCashuQuote locks the quote of paymentHash until the returned function is called.
+func lockCashuQuote(paymentHash string) (unlock func()) {
+	cashuQuoteLocksMu.Lock()
+	lock, ok := cashuQuoteLocks[paymentHash]
+	if !ok {
+		lock = &cashuQuoteLock{}
+		cashuQuoteLocks[paymentHash] = lock
+	}
+	lock.users++
+	cashuQuoteLocksMu.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+
+		cashuQuoteLocksMu.Lock()
+		lock.users--
+		if lock.users == 0 {
+			delete(cashuQuoteLocks, paymentHash)
+		}
+		cashuQuoteLocksMu.Unlock()
+	}
+}
+
+func (l CashuParams) getCert() string { return l.Cert }
+func (l CashuParams) isTor() bool {
+	return strings.Contains(l.Mint, ".onion")
+}
+
+func (l CashuParams) Capabilities() Capabilities {
+	return Capabilities{
+		DescriptionHash: false,
+		InvoiceLookup:   true,
+		MsatoshiStep:    1000,
+	}
+}
+
+func (l CashuParams) call(method, path string, body interface{}) (gjson.Result, error) {
+	var reqBody io.Reader
+	if body != nil {
+		b, err := jsoniter.Marshal(body)
+		if err != nil {
+			return gjson.Result{}, err
+		}
+		reqBody = bytes.NewBuffer(b)
+	}
+
+	req, err := http.NewRequest(method, l.Mint+path, reqBody)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := clientFor(l).Do(req)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return gjson.Result{}, fmt.Errorf("call to cashu mint failed (%d): %s", resp.StatusCode, responseErrorText(resp))
+	}
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	return gjson.ParseBytes(b), nil
+}
+
+func (l CashuParams) MakeInvoice(params LNParams) (bolt11 string, err error) {
+	// mints count in whole satoshis
+	if params.Msatoshi%1000 != 0 {
+		return "", errors.New("cashu mints only accept whole satoshi amounts")
+	}
+
+	result, err := l.call("POST", "/v1/mint/quote/bolt11", map[string]interface{}{
+		"amount": params.Msatoshi / 1000,
+		"unit":   "sat",
+	})
+	if err != nil {
+		return "", err
+	}
+
+	bolt11 = result.Get("request").String()
+	decoded, err := decodepay.Decodepay(bolt11)
+	if err != nil {
+		return "", fmt.Errorf("cashu mint returned an invalid invoice: %w", err)
+	}
+
+	if err := SaveCashuQuote(CashuQuote{
+		PaymentHash: decoded.PaymentHash,
+		Mint:        l.Mint,
+		Quote:       result.Get("quote").String(),
+		Amount:      params.Msatoshi / 1000,
+		Owner:       l.Owner,
+	}); err != nil {
+		return "", err
+	}
+
+	return bolt11, nil
+}
+
+func (l CashuParams) LookupInvoice(paymentHash string) (InvoiceStatus, error) {
+	unlock := lockCashuQuote(paymentHash)
+	defer unlock()
+
+	quote, err := GetCashuQuote(paymentHash)
+	if err != nil {
+		return InvoiceStatus{}, err
+	}
+
+	// quotes are always followed on the mint they were created on
+	mint := l
+	if quote.Mint != l.Mint {
+		mint = CashuParams{Mint: quote.Mint, Owner: quote.Owner}
+	}
+	result, err := mint.call("GET", "/v1/mint/quote/bolt11/"+quote.Quote, nil)
+	if err != nil {
+		return InvoiceStatus{}, err
+	}
+
+	// older mints only report a paid flag
+	state := result.Get("state").String()
+	if state == "" && result.Get("paid").Bool() {
+		state = "PAID"
+	}
+
+	var proofs []CashuProof
+	switch state {
+	case "PAID":
+		if proofs, err = mint.mintProofs(&quote); err != nil {
+			return InvoiceStatus{}, fmt.Errorf("failed to mint paid cashu quote: %w", err)
+		}
+	case "ISSUED":
+		// we minted it, but the proofs never made it into the db
+		if proofs, err = mint.restoreProofs(quote); err != nil {
+			return InvoiceStatus{}, fmt.Errorf("failed to restore issued cashu quote: %w", err)
+		}
+	default:
+		return InvoiceStatus{}, nil
+	}
+
+	if err := StoreCashuMint(quote, proofs); err != nil {
+		return InvoiceStatus{}, err
+	}
+	return InvoiceStatus{
+		Paid:             true,
+		PaidAt:           time.Now(),
+		MSatoshiReceived: quote.Amount * 1000,
+	}, nil
+}
+
+// Health checks that the mint is reachable and has an active sat keyset.
+func (l CashuParams) Health() error {
+	_, err := l.activeKeyset()
+	return err
+}
+
+func (l CashuParams) activeKeyset() (string, error) {
+	result, err := l.call("GET", "/v1/keysets", nil)
+	if err != nil {
+		return "", err
+	}
+
+	for _, keyset := range result.Get("keysets").Array() {
+		if keyset.Get("unit").String() == "sat" && keyset.Get("active").Bool() {
+			return keyset.Get("id").String(), nil
+		}
+	}
+	return "", fmt.Errorf("cashu mint %s has no active sat keyset", l.Mint)
+}
+
+// mintProofs asks the mint to sign blinded messages for the quote amount (NUT-00)
+// and unblinds the signatures into proofs. The outputs are saved with the
+// quote before they are sent, so the proofs can be restored if we lose them.
+func (l CashuParams) mintProofs(quote *CashuQuote) ([]CashuProof, error) {
+	if len(quote.Outputs) == 0 {
+		keysetId, err := l.activeKeyset()
+		if err != nil {
+			return nil, err
+		}
+		outputs, err := cashuBlindOutputs(quote.Amount)
+		if err != nil {
+			return nil, err
+		}
+
+		quote.KeysetId = keysetId
+		quote.Outputs = outputs
+		if err := SaveCashuQuote(*quote); err != nil {
+			return nil, err
+		}
+	}
+
+	result, err := l.call("POST", "/v1/mint/bolt11", map[string]interface{}{
+		"quote":   quote.Quote,
+		"outputs": quote.blindedMessages(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return l.unblind(*quote, result.Get("signatures").Array())
+}
+
+// restoreProofs gets the signatures for the saved outputs of an issued quote
+// from the mint again (NUT-09).
+func (l CashuParams) restoreProofs(quote CashuQuote) ([]CashuProof, error) {
+	if len(quote.Outputs) == 0 {
+		return nil, errors.New("the outputs sent to the mint weren't saved")
+	}
+
+	result, err := l.call("POST", "/v1/restore", map[string]interface{}{
+		"outputs": quote.blindedMessages(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// the mint only returns the outputs it signed, older mints call the signatures promises
+	signatures := result.Get("signatures")
+	if !signatures.Exists() {
+		signatures = result.Get("promises")
+	}
+	signed := make(map[string]gjson.Result)
+	for i, output := range result.Get("outputs").Array() {
+		signed[output.Get("B_").String()] = signatures.Get(strconv.Itoa(i))
+	}
+
+	ordered := make([]gjson.Result, len(quote.Outputs))
+	for i, output := range quote.Outputs {
+		signature, ok := signed[output.B_]
+		if !ok || !signature.Exists() {
+			return nil, fmt.Errorf("cashu mint has no signature for output %d", i)
+		}
+		ordered[i] = signature
+	}
+	return l.unblind(quote, ordered)
+}
+
+// cashuBlindOutputs makes one blinded message per power of two in amount.
+func cashuBlindOutputs(amount int64) ([]CashuOutput, error) {
+	var outputs []CashuOutput
+	for bit := 0; bit < 63; bit++ {
+		value := int64(1) << bit
+		if amount&value == 0 {
+			continue
+		}
+
+		secretBytes := make([]byte, 32)
+		if _, err := rand.Read(secretBytes); err != nil {
+			return nil, err
+		}
+		secret := hex.EncodeToString(secretBytes)
+
+		Y, err := cashuHashToCurve([]byte(secret))
+		if err != nil {
+			return nil, err
+		}
+		r, err := btcec.NewPrivateKey()
+		if err != nil {
+			return nil, err
+		}
+
+		// B_ = Y + rG
+		var y, rG, b btcec.JacobianPoint
+		Y.AsJacobian(&y)
+		btcec.ScalarBaseMultNonConst(&r.Key, &rG)
+		btcec.AddNonConst(&y, &rG, &b)
+		b.ToAffine()
+
+		outputs = append(outputs, CashuOutput{
+			Amount: value,
+			Secret: secret,
+			R:      hex.EncodeToString(r.Serialize()),
+			B_:     hex.EncodeToString(btcec.NewPublicKey(&b.X, &b.Y).SerializeCompressed()),
+		})
+	}
+	return outputs, nil
+}
+
+func (quote CashuQuote) blindedMessages() []map[string]interface{} {
+	messages := make([]map[string]interface{}, len(quote.Outputs))
+	for i, output := range quote.Outputs {
+		messages[i] = map[string]interface{}{
+			"amount": output.Amount,
+			"id":     quote.KeysetId,
+			"B_":     output.B_,
+		}
+	}
+	return messages
+}
+
+// unblind turns the mint's signatures on the quote outputs, in the same order,
+// into proofs.
+func (l CashuParams) unblind(quote CashuQuote, signatures []gjson.Result) ([]CashuProof, error) {
+	if len(signatures) != len(quote.Outputs) {
+		return nil, fmt.Errorf("cashu mint returned %d signatures for %d outputs", len(signatures), len(quote.Outputs))
+	}
+
+	keys, err := l.call("GET", "/v1/keys/"+quote.KeysetId, nil)
+	if err != nil {
+		return nil, err
+	}
+	mintKeys := keys.Get("keysets.0.keys")
+
+	proofs := make([]CashuProof, len(signatures))
+	for i, signature := range signatures {
+		output := quote.Outputs[i]
+		amount := strconv.FormatInt(output.Amount, 10)
+		K, err := cashuParsePoint(mintKeys.Get(amount).String())
+		if err != nil {
+			return nil, fmt.Errorf("invalid cashu mint key for amount %s: %w", amount, err)
+		}
+		blindSignature, err := cashuParsePoint(signature.Get("C_").String())
+		if err != nil {
+			return nil, fmt.Errorf("invalid cashu blind signature: %w", err)
+		}
+		rBytes, err := hex.DecodeString(output.R)
+		if err != nil {
+			return nil, fmt.Errorf("invalid saved blinding factor: %w", err)
+		}
+		r, _ := btcec.PrivKeyFromBytes(rBytes)
+
+		// C = C_ - rK
+		var negR btcec.ModNScalar
+		negR.Set(&r.Key).Negate()
+		var k, c_, rK, c btcec.JacobianPoint
+		K.AsJacobian(&k)
+		blindSignature.AsJacobian(&c_)
+		btcec.ScalarMultNonConst(&negR, &k, &rK)
+		btcec.AddNonConst(&c_, &rK, &c)
+		c.ToAffine()
+
+		proofs[i] = CashuProof{
+			Amount: output.Amount,
+			Id:     quote.KeysetId,
+			Secret: output.Secret,
+			C:      hex.EncodeToString(btcec.NewPublicKey(&c.X, &c.Y).SerializeCompressed()),
+		}
+	}
+	return proofs, nil
+}
+
+func cashuParsePoint(hexPoint string) (*btcec.PublicKey, error) {
+	b, err := hex.DecodeString(hexPoint)
+	if err != nil {
+		return nil, err
+	}
+	return btcec.ParsePubKey(b)
+}
+
+// cashuHashToCurve maps a secret to a point as specified in NUT-00.
+func cashuHashToCurve(message []byte) (*btcec.PublicKey, error) {
+	msgHash := sha256.Sum256(append([]byte("Secp256k1_HashToCurve_Cashu_"), message...))
+
+	for counter := uint32(0); counter < 1<<16; counter++ {
+		var counterBytes [4]byte
+		binary.LittleEndian.PutUint32(counterBytes[:], counter)
+
+		hash := sha256.Sum256(append(msgHash[:], counterBytes[:]...))
+		if point, err := btcec.ParsePubKey(append([]byte{0x02}, hash[:]...)); err == nil {
+			return point, nil
+		}
+	}
+	return nil, errors.New("no point found on the curve for this secret")
+}
+
+// encodeCashuToken serializes proofs as a cashuA token (NUT-00 V3) that any
+// cashu wallet can receive.
+func encodeCashuToken(proofs []CashuMintProofs) (string, error) {
+	b, err := jsoniter.Marshal(map[string]interface{}{
+		"token": proofs,
+		"unit":  "sat",
+	})
+	if err != nil {
+		return "", err
+	}
+	return "cashuA" + base64.URLEncoding.EncodeToString(b), nil
+}
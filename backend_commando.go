@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	lnsocket "github.com/jb55/lnsocket/go"
+	"github.com/lightningnetwork/lnd/brontide"
+	"github.com/lightningnetwork/lnd/keychain"
+	"github.com/lightningnetwork/lnd/lnwire"
+	"github.com/lightningnetwork/lnd/tor"
+	"github.com/tidwall/gjson"
+)
+
+func init() {
+	registerBackendKind("commando", func(params *Params) BackendParams {
+		return CommandoParams{
+			Host:   params.Host,
+			NodeId: params.NodeId,
+			Rune:   params.Rune,
+		}
+	})
+}
+
+type CommandoParams struct {
+	Rune   string
+	Host   string
+	NodeId string
+}
+
+func (l CommandoParams) getCert() string { return "" }
+func (l CommandoParams) isTor() bool {
+	return strings.Contains(l.Host, ".onion")
+}
+
+func (l CommandoParams) Capabilities() Capabilities {
+	return Capabilities{
+		DescriptionHash: true,
+		InvoiceLookup:   true,
+	}
+}
+
+// commando connections are kept open per node, so invoices and status checks
+// don't each need a new noise handshake. Idle connections closed by the node
+// are replaced on the next call.
+type commandoPool struct {
+	mu   sync.Mutex
+	key  *keychain.PrivKeyECDH
+	idle []*lnsocket.LNSocket
+}
+
+const commandoMaxIdle = 4
+
+var commandoPools sync.Map
+
+func (l CommandoParams) pool() *commandoPool {
+	if pool, ok := commandoPools.Load(l.Host + "|" + l.NodeId); ok {
+		return pool.(*commandoPool)
+	}
+
+	privateKey, _ := btcec.NewPrivateKey()
+	pool, _ := commandoPools.LoadOrStore(l.Host+"|"+l.NodeId, &commandoPool{
+		key: &keychain.PrivKeyECDH{PrivKey: privateKey},
+	})
+	return pool.(*commandoPool)
+}
+
+// get returns an idle connection to the node, or a new one. reused tells
+// whether it was idle, in which case the node may have closed it meanwhile.
+func (l CommandoParams) get() (ln *lnsocket.LNSocket, reused bool, err error) {
+	pool := l.pool()
+
+	pool.mu.Lock()
+	if n := len(pool.idle); n > 0 {
+		ln = pool.idle[n-1]
+		pool.idle = pool.idle[:n-1]
+	}
+	pool.mu.Unlock()
+	if ln != nil {
+		return ln, true, nil
+	}
+
+	ln, err = l.connect(pool.key)
+	return ln, false, err
+}
+
+// put returns a healthy connection to the pool.
+func (l CommandoParams) put(ln *lnsocket.LNSocket) {
+	ln.Conn.SetDeadline(time.Time{})
+
+	pool := l.pool()
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	if len(pool.idle) >= commandoMaxIdle {
+		ln.Disconnect()
+		return
+	}
+	pool.idle = append(pool.idle, ln)
+}
+
+func (l CommandoParams) connect(key *keychain.PrivKeyECDH) (*lnsocket.LNSocket, error) {
+	pubkey, err := hex.DecodeString(l.NodeId)
+	if err != nil {
+		return nil, fmt.Errorf("invalid node id: %w", err)
+	}
+	identityKey, err := btcec.ParsePubKey(pubkey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid node id: %w", err)
+	}
+
+	netAddr := &lnwire.NetAddress{IdentityKey: identityKey}
+	dial := net.DialTimeout
+
+	// onion nodes are dialed through the tor socks proxy
+	if l.isTor() {
+		torURL, err := url.Parse(TorProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tor proxy url: %w", err)
+		}
+		if netAddr.Address, err = tor.ParseAddr(l.Host, torURL.Host); err != nil {
+			return nil, err
+		}
+		dial = func(_, address string, timeout time.Duration) (net.Conn, error) {
+			return tor.Dial(address, torURL.Host, false, false, timeout)
+		}
+	} else if netAddr.Address, err = net.ResolveTCPAddr("tcp", l.Host); err != nil {
+		return nil, err
+	}
+
+	conn, err := brontide.Dial(key, netAddr, ClientTimeout, dial)
+	if err != nil {
+		return nil, err
+	}
+
+	ln := &lnsocket.LNSocket{Conn: conn, PrivKeyECDH: key}
+	conn.SetDeadline(time.Now().Add(ClientTimeout))
+	if err := ln.PerformInit(); err != nil {
+		ln.Disconnect()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return ln, nil
+}
+
+// call runs a single commando rpc call on a pooled connection and returns its "result" object.
+func (l CommandoParams) call(method string, params map[string]interface{}) (gjson.Result, error) {
+	for {
+		ln, reused, err := l.get()
+		if err != nil {
+			return gjson.Result{}, err
+		}
+
+		ln.Conn.SetDeadline(time.Now().Add(ClientTimeout))
+		result, err := commandoRpc(ln, l.Rune, method, params)
+		if _, isRpcError := err.(commandoError); err != nil && !isRpcError {
+			// the connection is broken, try again on a new one if it was an old one
+			ln.Disconnect()
+			if reused {
+				continue
+			}
+			return gjson.Result{}, err
+		}
+
+		l.put(ln)
+		return result, err
+	}
+}
+
+// commandoError is an error returned by the node, as opposed to a connection failure.
+type commandoError string
+
+func (e commandoError) Error() string { return string(e) }
+
+func commandoRpc(ln *lnsocket.LNSocket, rune string, method string, params map[string]interface{}) (gjson.Result, error) {
+	jparams, _ := json.Marshal(params)
+
+	body, err := ln.Rpc(rune, method, string(jparams))
+	if err != nil {
+		return gjson.Result{}, err
+	}
+
+	resErr := gjson.Get(body, "error")
+	if resErr.Type != gjson.Null {
+		if resErr.Type == gjson.JSON {
+			return gjson.Result{}, commandoError(resErr.Get("message").String())
+		} else if resErr.Type == gjson.String {
+			return gjson.Result{}, commandoError(resErr.String())
+		}
+		return gjson.Result{}, commandoError(fmt.Sprintf("unknown commando error: '%v'", resErr))
+	}
+
+	return gjson.Get(body, "result"), nil
+}
+
+func (l CommandoParams) MakeInvoice(params LNParams) (bolt11 string, err error) {
+	label := params.Label
+	if label == "" {
+		label = makeRandomLabel()
+	}
+
+	invoiceParams := map[string]interface{}{
+		"amount_msat": params.Msatoshi,
+		"label":       label,
+		"description": params.Description,
+	}
+	if params.UseDescriptionHash {
+		invoiceParams["deschashonly"] = true
+	}
+
+	result, err := l.call("invoice", invoiceParams)
+	if err != nil {
+		return "", err
+	}
+
+	invoice := result.Get("bolt11")
+	if invoice.Type != gjson.String {
+		return "", fmt.Errorf("no bolt11 result found in invoice response, got %v", result)
+	}
+
+	return invoice.String(), nil
+}
+
+func (l CommandoParams) LookupInvoice(paymentHash string) (InvoiceStatus, error) {
+	// Call the listinvoices RPC command to retrieve invoice details
+	result, err := l.call("listinvoices", map[string]interface{}{
+		"payment_hash": paymentHash,
+	})
+	if err != nil {
+		return InvoiceStatus{}, fmt.Errorf("error getting invoice: %w", err)
+	}
+
+	var status InvoiceStatus
+	for _, invoice := range result.Get("invoices").Array() {
+		if status = clnInvoiceStatus(invoice); status.Paid {
+			break
+		}
+	}
+	return status, nil
+}
+
+func (l CommandoParams) WaitInvoice(ctx context.Context, paymentHash string) (InvoiceStatus, error) {
+	// waitinvoice takes a label, so we find the invoice first
+	result, err := l.call("listinvoices", map[string]interface{}{
+		"payment_hash": paymentHash,
+	})
+	if err != nil {
+		return InvoiceStatus{}, fmt.Errorf("error getting invoice: %w", err)
+	}
+	invoices := result.Get("invoices").Array()
+	if len(invoices) == 0 {
+		return InvoiceStatus{}, errors.New("invoice not found")
+	}
+	if status := clnInvoiceStatus(invoices[0]); status.Paid {
+		return status, nil
+	}
+
+	// the wait holds a connection of its own until it returns
+	ln, _, err := l.get()
+	if err != nil {
+		return InvoiceStatus{}, err
+	}
+
+	// closing the connection is the only way to abort a pending waitinvoice
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			ln.Disconnect()
+		case <-done:
+		}
+	}()
+
+	invoice, err := commandoRpc(ln, l.Rune, "waitinvoice", map[string]interface{}{
+		"label": invoices[0].Get("label").String(),
+	})
+	close(done)
+	<-stopped
+	if err != nil {
+		ln.Disconnect()
+		return InvoiceStatus{}, fmt.Errorf("error waiting for invoice: %w", err)
+	}
+	if ctx.Err() == nil {
+		l.put(ln)
+	}
+	return clnInvoiceStatus(invoice), nil
+}
+
+func (l CommandoParams) Health() error {
+	// runes are usually restricted to invoice methods, so a successful
+	// handshake is all we check for here
+	ln, err := l.connect(l.pool().key)
+	if err != nil {
+		return err
+	}
+	l.put(ln)
+	return nil
+}
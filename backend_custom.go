@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+func init() {
+	registerBackendKind("custom", func(params *Params) BackendParams {
+		backend := CustomParams{}
+		if params.CustomInvoice != nil {
+			backend.Invoice = *params.CustomInvoice
+		}
+		if params.CustomStatus != nil {
+			backend.Status = *params.CustomStatus
+		}
+		return backend
+	})
+}
+
+// CustomRequest describes one http call to a wallet. URL and Body are Go
+// templates executed with customTemplateData, Path is a gjson path into the
+// response.
+type CustomRequest struct {
+	URL     string            `json:"url"`
+	Method  string            `json:"method,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    string            `json:"body,omitempty"`
+	Path    string            `json:"path"`
+
+	// only for status requests: the invoice is paid when the value at Path
+	// equals this, or when it is true if this is empty
+	PaidValue string `json:"paid_value,omitempty"`
+}
+
+type customTemplateData struct {
+	Msatoshi              int64
+	Satoshi               int64
+	Description           string
+	DescriptionHash       string
+	DescriptionHashBase64 string
+	Label                 string
+	PaymentHash           string
+}
+
+var customTemplateFuncs = template.FuncMap{
+	// json quotes a value for use inside a json body template
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// CustomParams lets any wallet with an http api back an address: Invoice
+// creates the bolt11, Status (optional) tells whether it was paid. Anyone who
+// can register sets these requests, so they only go to public addresses.
+type CustomParams struct {
+	Invoice CustomRequest
+	Status  CustomRequest
+}
+
+func (l CustomParams) getCert() string { return "" }
+func (l CustomParams) isTor() bool {
+	return strings.Contains(l.Invoice.URL, ".onion") || strings.Contains(l.Status.URL, ".onion")
+}
+
+// client returns the tor client for onion urls and publicClient for the rest,
+// so an onion invoice url doesn't send the status request through tor.
+func (l CustomParams) client(request CustomRequest) *http.Client {
+	if strings.Contains(request.URL, ".onion") {
+		return clientFor(l)
+	}
+	return getPublicClient()
+}
+
+func (l CustomParams) Capabilities() Capabilities {
+	return Capabilities{
+		DescriptionHash: strings.Contains(l.Invoice.URL+l.Invoice.Body, "DescriptionHash"),
+		InvoiceLookup:   l.Status.URL != "",
+		MsatoshiStep:    customMsatoshiStep(l.Invoice),
+	}
+}
+
+// wallets given the amount in satoshis can only invoice whole satoshis
+func customMsatoshiStep(request CustomRequest) int64 {
+	if strings.Contains(request.URL+request.Body, ".Satoshi") {
+		return 1000
+	}
+	return 0
+}
+
+func (c CustomRequest) execute(client *http.Client, data customTemplateData) (gjson.Result, error) {
+	render := func(name, text string) (string, error) {
+		tmpl, err := template.New(name).Funcs(customTemplateFuncs).Parse(text)
+		if err != nil {
+			return "", fmt.Errorf("invalid %s template: %w", name, err)
+		}
+		var out strings.Builder
+		if err := tmpl.Execute(&out, data); err != nil {
+			return "", fmt.Errorf("failed to render %s template: %w", name, err)
+		}
+		return out.String(), nil
+	}
+
+	url, err := render("url", c.URL)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	body, err := render("body", c.Body)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+
+	method := strings.ToUpper(c.Method)
+	if method == "" {
+		method = "GET"
+		if body != "" {
+			method = "POST"
+		}
+	}
+
+	var reqBody io.Reader
+	if body != "" {
+		reqBody = bytes.NewBufferString(body)
+	}
+	req, err := http.NewRequest(method, url, reqBody)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for name, value := range c.Headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		// the url is user-given, its response isn't shown to whoever set it up
+		return gjson.Result{}, fmt.Errorf("call to custom wallet failed (%d)", resp.StatusCode)
+	}
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	return gjson.ParseBytes(b), nil
+}
+
+func (l CustomParams) MakeInvoice(params LNParams) (bolt11 string, err error) {
+	hexh, b64h := params.descriptionHash()
+
+	result, err := l.Invoice.execute(l.client(l.Invoice), customTemplateData{
+		Msatoshi:              params.Msatoshi,
+		Satoshi:               params.Msatoshi / 1000,
+		Description:           params.Description,
+		DescriptionHash:       hexh,
+		DescriptionHashBase64: b64h,
+		Label:                 params.Label,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	invoice := result.Get(l.Invoice.Path)
+	if invoice.Type != gjson.String {
+		return "", fmt.Errorf("no invoice found at %s in custom wallet response", l.Invoice.Path)
+	}
+	return invoice.String(), nil
+}
+
+func (l CustomParams) LookupInvoice(paymentHash string) (InvoiceStatus, error) {
+	result, err := l.Status.execute(l.client(l.Status), customTemplateData{PaymentHash: paymentHash})
+	if err != nil {
+		return InvoiceStatus{}, err
+	}
+
+	value := result.Get(l.Status.Path)
+	paid := value.Bool()
+	if l.Status.PaidValue != "" {
+		paid = value.String() == l.Status.PaidValue
+	}
+	if !paid {
+		return InvoiceStatus{}, nil
+	}
+
+	return InvoiceStatus{
+		Paid:   true,
+		PaidAt: time.Now(),
+	}, nil
+}
+
+// Health only validates the configuration, the test invoice created when the
+// address is saved shows whether the wallet actually works.
+func (l CustomParams) Health() error {
+	if l.Invoice.URL == "" || l.Invoice.Path == "" {
+		return errors.New("custom wallets need an invoice url and a path to the invoice in the response")
+	}
+	if l.Status.URL != "" && l.Status.Path == "" {
+		return errors.New("custom wallets with a status url need a path to the paid status in the response")
+	}
+
+	for _, text := range []string{l.Invoice.URL, l.Invoice.Body, l.Status.URL, l.Status.Body} {
+		if _, err := template.New("").Funcs(customTemplateFuncs).Parse(text); err != nil {
+			return fmt.Errorf("invalid custom wallet template: %w", err)
+		}
+	}
+	return nil
+}
+
+// customRequestFromForm reads a CustomRequest from the form fields starting
+// with prefix. Headers are given one per line as "Name: value".
+func customRequestFromForm(r *http.Request, prefix string) *CustomRequest {
+	url := r.FormValue(prefix + "_url")
+	if url == "" {
+		return nil
+	}
+
+	headers := make(map[string]string)
+	for _, line := range strings.Split(r.FormValue(prefix+"_headers"), "\n") {
+		name, value, ok := strings.Cut(line, ":")
+		if ok && strings.TrimSpace(name) != "" {
+			headers[strings.TrimSpace(name)] = strings.TrimSpace(value)
+		}
+	}
+
+	return &CustomRequest{
+		URL:       url,
+		Method:    r.FormValue(prefix + "_method"),
+		Headers:   headers,
+		Body:      r.FormValue(prefix + "_body"),
+		Path:      r.FormValue(prefix + "_path"),
+		PaidValue: r.FormValue(prefix + "_paid_value"),
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+func init() {
+	registerBackendKind("eclair", func(params *Params) BackendParams {
+		return EclairParams{
+			Host:     params.Host,
+			Password: params.Password,
+			Cert:     params.Cert,
+		}
+	})
+}
+
+// eclair answers 404 for payment hashes it doesn't know
+var errEclairNotFound = errors.New("not found on eclair")
+
+type EclairParams struct {
+	Host     string
+	Password string
+	Cert     string
+}
+
+func (l EclairParams) getCert() string { return l.Cert }
+func (l EclairParams) isTor() bool {
+	return strings.Contains(l.Host, ".onion")
+}
+
+// call posts a form to the eclair api, which authenticates with the api
+// password and an empty username.
+func (l EclairParams) call(method string, params map[string]interface{}) (gjson.Result, error) {
+	baseURL := l.Host
+	if !strings.HasPrefix(baseURL, "http") {
+		baseURL = "http://" + baseURL
+	}
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	for k, v := range params {
+		if err := writer.WriteField(k, fmt.Sprintf("%v", v)); err != nil {
+			return gjson.Result{}, err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return gjson.Result{}, err
+	}
+
+	req, err := http.NewRequest("POST", strings.TrimSuffix(baseURL, "/")+"/"+method, body)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.SetBasicAuth("", l.Password)
+
+	resp, err := clientFor(l).Do(req)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		return gjson.Result{}, errWrongPassword
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return gjson.Result{}, errEclairNotFound
+	}
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	result := gjson.ParseBytes(b)
+	if resp.StatusCode >= 300 {
+		if message := result.Get("error"); message.Exists() {
+			return gjson.Result{}, fmt.Errorf("eclair said: %s", message.String())
+		}
+		return gjson.Result{}, fmt.Errorf("call to eclair failed (%d): %s", resp.StatusCode, string(b))
+	}
+	return result, nil
+}
+
+func (l EclairParams) Capabilities() Capabilities {
+	return Capabilities{
+		DescriptionHash: true,
+		InvoiceLookup:   true,
+	}
+}
+
+func (l EclairParams) MakeInvoice(params LNParams) (bolt11 string, err error) {
+	hexh, _ := params.descriptionHash()
+
+	eclairParams := map[string]interface{}{"amountMsat": params.Msatoshi}
+
+	if params.UseDescriptionHash {
+		eclairParams["descriptionHash"] = hexh
+	} else {
+		eclairParams["description"] = params.Description
+	}
+
+	inv, err := l.call("createinvoice", eclairParams)
+	if err != nil {
+		return "", fmt.Errorf("error creating invoice on eclair: %w", err)
+	}
+
+	return inv.Get("serialized").String(), nil
+}
+
+func (l EclairParams) LookupInvoice(paymentHash string) (InvoiceStatus, error) {
+	info, err := l.call("getreceivedinfo", map[string]interface{}{"paymentHash": paymentHash})
+	if err != nil {
+		return InvoiceStatus{}, fmt.Errorf("error calling getreceivedinfo on eclair: %w", err)
+	}
+
+	if info.Get("status.type").String() != "received" {
+		return InvoiceStatus{}, nil
+	}
+
+	// newer eclair versions report timestamps as {unix, iso}, older ones as milliseconds
+	paidAt := time.Now()
+	if receivedAt := info.Get("status.receivedAt"); receivedAt.IsObject() {
+		paidAt = time.Unix(receivedAt.Get("unix").Int(), 0)
+	} else if receivedAt.Exists() {
+		paidAt = time.UnixMilli(receivedAt.Int())
+	}
+
+	return InvoiceStatus{
+		Paid:             true,
+		PaidAt:           paidAt,
+		MSatoshiReceived: info.Get("status.amount").Int(),
+	}, nil
+}
+
+// Health asks for a payment hash that doesn't exist, as an api exposed for
+// invoices only rejects getinfo. Not finding it means eclair answered.
+func (l EclairParams) Health() error {
+	var hash [32]byte
+	if _, err := rand.Read(hash[:]); err != nil {
+		return err
+	}
+
+	_, err := l.call("getreceivedinfo", map[string]interface{}{"paymentHash": hex.EncodeToString(hash[:])})
+	if err != nil && !errors.Is(err, errEclairNotFound) {
+		return fmt.Errorf("error calling getreceivedinfo on eclair: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/ecdsa"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/gorilla/mux"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/lightningnetwork/lnd/lnwire"
+	"github.com/lightningnetwork/lnd/zpay32"
+)
+
+func init() {
+	registerBackendKind("fake", func(params *Params) BackendParams {
+		return FakeParams{}
+	})
+}
+
+// FakeParams issues regtest invoices signed with a local key, which nobody can
+// actually pay. They are marked paid through the debug endpoint instead, so
+// the whole flow up to zap receipts and notifications runs without a node.
+// Only available when FAKE_BACKEND is set.
+type FakeParams struct{}
+
+type fakeInvoice struct {
+	msatoshi int64
+	paidAt   time.Time
+}
+
+var (
+	fakeInvoicesMu sync.Mutex
+	fakeInvoices   = make(map[string]*fakeInvoice) // by payment hash
+)
+
+var errFakeBackendDisabled = errors.New("the fake backend is not enabled on this server")
+
+// fakeNodeKey is derived from SECRET, so the fake node keeps its id across restarts.
+func fakeNodeKey() *btcec.PrivateKey {
+	seed := sha256.Sum256([]byte("fake node key " + s.Secret))
+	key, _ := btcec.PrivKeyFromBytes(seed[:])
+	return key
+}
+
+func (l FakeParams) getCert() string { return "" }
+func (l FakeParams) isTor() bool     { return false }
+
+func (l FakeParams) Capabilities() Capabilities {
+	return Capabilities{
+		DescriptionHash: true,
+		InvoiceLookup:   true,
+	}
+}
+
+func (l FakeParams) MakeInvoice(params LNParams) (bolt11 string, err error) {
+	if !s.FakeBackend {
+		return "", errFakeBackendDisabled
+	}
+
+	var preimage, paymentAddr [32]byte
+	if _, err := rand.Read(preimage[:]); err != nil {
+		return "", err
+	}
+	if _, err := rand.Read(paymentAddr[:]); err != nil {
+		return "", err
+	}
+	paymentHash := sha256.Sum256(preimage[:])
+
+	options := []func(*zpay32.Invoice){
+		zpay32.Amount(lnwire.MilliSatoshi(params.Msatoshi)),
+		zpay32.PaymentAddr(paymentAddr),
+		zpay32.Features(lnwire.NewFeatureVector(
+			lnwire.NewRawFeatureVector(lnwire.TLVOnionPayloadRequired, lnwire.PaymentAddrRequired),
+			lnwire.Features,
+		)),
+	}
+	if params.UseDescriptionHash {
+		options = append(options, zpay32.DescriptionHash(sha256.Sum256([]byte(params.Description))))
+	} else {
+		options = append(options, zpay32.Description(params.Description))
+	}
+
+	invoice, err := zpay32.NewInvoice(&chaincfg.RegressionNetParams, paymentHash, time.Now(), options...)
+	if err != nil {
+		return "", err
+	}
+
+	key := fakeNodeKey()
+	bolt11, err = invoice.Encode(zpay32.MessageSigner{
+		SignCompact: func(msg []byte) ([]byte, error) {
+			hash := sha256.Sum256(msg)
+			return ecdsa.SignCompact(key, hash[:], true)
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	fakeInvoicesMu.Lock()
+	fakeInvoices[hex.EncodeToString(paymentHash[:])] = &fakeInvoice{msatoshi: params.Msatoshi}
+	fakeInvoicesMu.Unlock()
+
+	return bolt11, nil
+}
+
+func (l FakeParams) LookupInvoice(paymentHash string) (InvoiceStatus, error) {
+	fakeInvoicesMu.Lock()
+	defer fakeInvoicesMu.Unlock()
+
+	invoice, ok := fakeInvoices[paymentHash]
+	if !ok {
+		return InvoiceStatus{}, errors.New("unknown fake invoice")
+	}
+	if invoice.paidAt.IsZero() {
+		return InvoiceStatus{}, nil
+	}
+
+	return InvoiceStatus{
+		Paid:             true,
+		PaidAt:           invoice.paidAt,
+		MSatoshiReceived: invoice.msatoshi,
+	}, nil
+}
+
+func (l FakeParams) Health() error {
+	if !s.FakeBackend {
+		return errFakeBackendDisabled
+	}
+	return nil
+}
+
+// PayFakeInvoice marks an invoice of the fake backend as paid. The watcher
+// picks it up on its next poll. Requires SECRET in the X-Secret header.
+func PayFakeInvoice(w http.ResponseWriter, r *http.Request) {
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Secret")), []byte(s.Secret)) != 1 {
+		sendError(w, 401, "wrong secret")
+		return
+	}
+
+	paymentHash := mux.Vars(r)["hash"]
+
+	fakeInvoicesMu.Lock()
+	invoice, ok := fakeInvoices[paymentHash]
+	if ok && invoice.paidAt.IsZero() {
+		invoice.paidAt = time.Now()
+	}
+	fakeInvoicesMu.Unlock()
+
+	if !ok {
+		sendError(w, 404, "unknown fake invoice: %s", paymentHash)
+		return
+	}
+
+	response := Response{
+		Ok:      true,
+		Message: fmt.Sprintf("marked %s as paid", paymentHash),
+		Data:    nil,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	jsoniter.NewEncoder(w).Encode(response)
+}
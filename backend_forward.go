@@ -0,0 +1,240 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/fiatjaf/go-lnurl"
+	"github.com/nbd-wtf/go-nostr"
+	decodepay "github.com/nbd-wtf/ln-decodepay"
+)
+
+func init() {
+	registerBackendKind("forward", func(params *Params) BackendParams {
+		return ForwardParams{
+			Host: params.Host,
+		}
+	})
+}
+
+// ForwardParams is used by accounts that forward to another lightning address.
+// They never issue invoices themselves, the LNURL-pay flow is proxied to the
+// target instead. Host is the target as a lightning address, bech32 lnurl or
+// plain LNURL-pay url.
+type ForwardParams struct {
+	Host string
+}
+
+func (l ForwardParams) getCert() string { return "" }
+func (l ForwardParams) isTor() bool {
+	return strings.Contains(l.Host, ".onion")
+}
+
+func (l ForwardParams) Capabilities() Capabilities {
+	return Capabilities{
+		DescriptionHash: false,
+		InvoiceLookup:   false,
+	}
+}
+
+func (l ForwardParams) MakeInvoice(params LNParams) (bolt11 string, err error) {
+	return "", errors.New("forward accounts do not issue invoices")
+}
+
+func (l ForwardParams) LookupInvoice(paymentHash string) (InvoiceStatus, error) {
+	return InvoiceStatus{}, errLookupUnsupported
+}
+
+// Health resolves the forward target and checks that it looks like a working
+// LNURL-pay endpoint.
+func (l ForwardParams) Health() error {
+	payParams, err := l.payParams()
+	if err != nil {
+		return err
+	}
+
+	if payParams.MinSendable <= 0 || payParams.MaxSendable < payParams.MinSendable {
+		return fmt.Errorf("forward target has invalid amounts (min: %d msat, max: %d msat)",
+			payParams.MinSendable, payParams.MaxSendable)
+	}
+
+	var metadata [][]interface{}
+	if err := json.Unmarshal([]byte(payParams.EncodedMetadata), &metadata); err != nil {
+		return fmt.Errorf("forward target has invalid metadata: %w", err)
+	}
+	hasText := false
+	for _, entry := range metadata {
+		if len(entry) == 2 && entry[0] == "text/plain" {
+			hasText = true
+		}
+	}
+	if !hasText {
+		return errors.New("forward target metadata has no text/plain description")
+	}
+	return nil
+}
+
+// targetURL returns the LNURL-pay url of the forward target.
+func (l ForwardParams) targetURL() (string, error) {
+	target := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(l.Host), "lightning:"))
+	lower := strings.ToLower(target)
+
+	switch {
+	case strings.HasPrefix(lower, "lnurl1"):
+		return lnurl.LNURLDecode(target)
+	case strings.HasPrefix(lower, "lnurlp://"):
+		target = "https://" + target[len("lnurlp://"):]
+		if u, err := url.Parse(target); err == nil && strings.HasSuffix(u.Hostname(), ".onion") {
+			target = "http://" + target[len("https://"):]
+		}
+		return target, nil
+	case strings.HasPrefix(lower, "https://"), strings.HasPrefix(lower, "http://"):
+		return target, nil
+	}
+
+	// LUD-16 lightning address
+	if name, domain, ok := lnurl.ParseInternetIdentifier(target); ok {
+		scheme := "https"
+		if strings.HasSuffix(domain, ".onion") {
+			scheme = "http"
+		}
+		return fmt.Sprintf("%s://%s/.well-known/lnurlp/%s", scheme, domain, name), nil
+	}
+
+	return "", fmt.Errorf("forward target '%s' is not a lightning address or lnurl", l.Host)
+}
+
+// payParams fetches the LNURL-pay parameters of the forward target.
+func (l ForwardParams) payParams() (LNURLPayParamsCustom, error) {
+	target, err := l.targetURL()
+	if err != nil {
+		return LNURLPayParamsCustom{}, err
+	}
+
+	if err := checkForwardTarget(target); err != nil {
+		return LNURLPayParamsCustom{}, err
+	}
+
+	var payParams LNURLPayParamsCustom
+	if err := getLNURLJSON(publicClientFor(l), target, &payParams); err != nil {
+		return LNURLPayParamsCustom{}, err
+	}
+	if payParams.Tag != "payRequest" {
+		return LNURLPayParamsCustom{}, fmt.Errorf("forward target is not a pay request but '%s'", payParams.Tag)
+	}
+	if payParams.Callback == "" {
+		return LNURLPayParamsCustom{}, errors.New("forward target has no callback")
+	}
+	if err := checkForwardTarget(payParams.Callback); err != nil {
+		return LNURLPayParamsCustom{}, err
+	}
+	return payParams, nil
+}
+
+// checkForwardTarget refuses urls that don't use https (plain http is fine for
+// onions) and targets on our own domains, which could forward back to the
+// address they are called from.
+func checkForwardTarget(target string) error {
+	if err := checkPublicURL(target); err != nil {
+		return fmt.Errorf("invalid forward target: %w", err)
+	}
+	return nil
+}
+
+// fetchInvoice asks the forward target for an invoice, passing on the payer's
+// comment, zap request and payer data, and checks that the invoice is for the
+// requested amount and commits to what the payer will check it against.
+func (l ForwardParams) fetchInvoice(payParams LNURLPayParamsCustom, msat int64, query url.Values) (lnurl.LNURLPayValues, error) {
+	callback, err := url.Parse(payParams.Callback)
+	if err != nil {
+		return lnurl.LNURLPayValues{}, fmt.Errorf("forward target has an invalid callback: %w", err)
+	}
+
+	callbackQuery := callback.Query()
+	callbackQuery.Set("amount", strconv.FormatInt(msat, 10))
+	for _, key := range []string{"comment", "payerdata"} {
+		if value := query.Get(key); value != "" {
+			callbackQuery.Set(key, value)
+		}
+	}
+	zapRequest := ""
+	if payParams.AllowsNostr {
+		zapRequest = query.Get("nostr")
+		if zapRequest != "" {
+			callbackQuery.Set("nostr", zapRequest)
+		}
+	}
+	callback.RawQuery = callbackQuery.Encode()
+
+	var values lnurl.LNURLPayValues
+	if err := getLNURLJSON(publicClientFor(l), callback.String(), &values); err != nil {
+		return lnurl.LNURLPayValues{}, err
+	}
+
+	invoice, err := decodepay.Decodepay(values.PR)
+	if err != nil {
+		return lnurl.LNURLPayValues{}, fmt.Errorf("forward target returned an invalid invoice: %w", err)
+	}
+	if invoice.MSatoshi != msat {
+		return lnurl.LNURLPayValues{}, fmt.Errorf("forward target returned an invoice for %d msat instead of %d", invoice.MSatoshi, msat)
+	}
+
+	// zaps commit to the zap request, everything else to the metadata and payer data (LUD-18)
+	if invoice.DescriptionHash != "" {
+		committed := []string{payParams.EncodedMetadata + query.Get("payerdata")}
+		if zapRequest != "" {
+			// targets may commit to the zap request as sent or re-serialized, like we do
+			committed = []string{zapRequest}
+			var zapEvent nostr.Event
+			if err := json.Unmarshal([]byte(zapRequest), &zapEvent); err == nil {
+				if serialized, err := json.Marshal(zapEvent); err == nil {
+					committed = append(committed, string(serialized))
+				}
+			}
+		}
+
+		matches := false
+		for _, one := range committed {
+			hash := sha256.Sum256([]byte(one))
+			matches = matches || invoice.DescriptionHash == hex.EncodeToString(hash[:])
+		}
+		if !matches {
+			return lnurl.LNURLPayValues{}, errors.New("forward target returned an invoice with the wrong description hash")
+		}
+	}
+
+	return values, nil
+}
+
+// getLNURLJSON fetches an LNURL endpoint and decodes its json response,
+// turning LNURL error responses into errors.
+func getLNURLJSON(client *http.Client, target string, v interface{}) error {
+	resp, err := client.Get(target)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("call to forward target failed (%d): %s", resp.StatusCode, responseErrorText(resp))
+	}
+
+	var body json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return fmt.Errorf("forward target returned invalid json: %w", err)
+	}
+
+	var status lnurl.LNURLResponse
+	json.Unmarshal(body, &status)
+	if strings.EqualFold(status.Status, "ERROR") {
+		return fmt.Errorf("forward target returned an error: %s", status.Reason)
+	}
+
+	return json.Unmarshal(body, v)
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+func init() {
+	registerBackendKind("lnbits", func(params *Params) BackendParams {
+		return LNBitsParams{
+			Host: params.Host,
+			Key:  params.Key,
+			Cert: params.Cert,
+		}
+	})
+}
+
+type LNBitsParams struct {
+	Cert string
+	Host string
+	Key  string
+}
+
+func (l LNBitsParams) getCert() string { return l.Cert }
+func (l LNBitsParams) isTor() bool {
+	return strings.Contains(l.Host, ".onion")
+}
+
+func (l LNBitsParams) Capabilities() Capabilities {
+	return Capabilities{
+		DescriptionHash: true,
+		InvoiceLookup:   true,
+		MsatoshiStep:    1000,
+	}
+}
+
+func (l LNBitsParams) call(method, path string, body io.Reader) ([]byte, error) {
+	req, err := http.NewRequest(method, l.Host+path, body)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("X-Api-Key", l.Key)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := clientFor(l).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("call to lnbits failed (%d): %s", resp.StatusCode, responseErrorText(resp))
+	}
+
+	return io.ReadAll(resp.Body)
+}
+
+func (l LNBitsParams) MakeInvoice(params LNParams) (bolt11 string, err error) {
+	body, _ := sjson.Set("{}", "amount", params.Msatoshi/1000)
+	body, _ = sjson.Set(body, "out", false)
+
+	if params.UseDescriptionHash {
+		body, _ = sjson.Set(body, "unhashed_description", hex.EncodeToString([]byte(params.Description)))
+	} else {
+		if params.Description == "" {
+			body, _ = sjson.Set(body, "memo", "created by makeinvoice")
+		} else {
+			body, _ = sjson.Set(body, "memo", params.Description)
+		}
+		if s.LNDprivateOnly {
+			body, _ = sjson.Set(body, "private", true)
+		}
+	}
+
+	b, err := l.call("POST", "/api/v1/payments", bytes.NewBufferString(body))
+	if err != nil {
+		return "", err
+	}
+
+	return gjson.ParseBytes(b).Get("payment_request").String(), nil
+}
+
+func (l LNBitsParams) LookupInvoice(paymentHash string) (InvoiceStatus, error) {
+	b, err := l.call("GET", "/api/v1/payments/"+paymentHash, nil)
+	if err != nil {
+		return InvoiceStatus{}, err
+	}
+
+	payment := gjson.ParseBytes(b)
+	if !payment.Get("paid").Bool() {
+		return InvoiceStatus{}, nil
+	}
+
+	return InvoiceStatus{
+		Paid:             true,
+		PaidAt:           time.Now(),
+		MSatoshiReceived: payment.Get("details.amount").Int(),
+	}, nil
+}
+
+// lnbitsStream is the payment stream we keep open for one wallet while any
+// of its invoices is waited for, so pending invoices share one connection.
+type lnbitsStream struct {
+	cancel    context.CancelFunc
+	connected chan struct{} // closed once lnbits accepted the stream
+	done      chan struct{} // closed when the stream ended, after err is set
+	err       error
+	waiters   map[string][]chan gjson.Result // by payment hash
+}
+
+var (
+	lnbitsStreamsMu sync.Mutex
+	lnbitsStreams   = make(map[string]*lnbitsStream) // by backendKey
+)
+
+func (l LNBitsParams) WaitInvoice(ctx context.Context, paymentHash string) (InvoiceStatus, error) {
+	payments := make(chan gjson.Result, 1)
+	stream := lnbitsSubscribe(l, paymentHash, payments)
+	defer lnbitsUnsubscribe(l, stream, paymentHash, payments)
+
+	select {
+	case <-stream.connected:
+	case <-stream.done:
+		return InvoiceStatus{}, stream.err
+	case <-ctx.Done():
+		return InvoiceStatus{}, ctx.Err()
+	}
+
+	// the payment may have arrived before we subscribed
+	if status, err := LookupInvoice(l, paymentHash, ""); err == nil && status.Paid {
+		return status, nil
+	}
+
+	select {
+	case payment := <-payments:
+		return InvoiceStatus{
+			Paid:             true,
+			PaidAt:           time.Now(),
+			MSatoshiReceived: payment.Get("amount").Int(),
+		}, nil
+	case <-stream.done:
+		return InvoiceStatus{}, stream.err
+	case <-ctx.Done():
+		return InvoiceStatus{}, ctx.Err()
+	}
+}
+
+// lnbitsSubscribe registers a waiter for the payment with the given hash on
+// the stream of the wallet, opening the stream if there is none.
+func lnbitsSubscribe(l LNBitsParams, paymentHash string, payments chan gjson.Result) *lnbitsStream {
+	key := backendKey(l)
+
+	lnbitsStreamsMu.Lock()
+	defer lnbitsStreamsMu.Unlock()
+
+	stream, ok := lnbitsStreams[key]
+	if !ok {
+		// not tied to the waiter's context, the stream outlives single invoices
+		ctx, cancel := context.WithCancel(context.Background())
+		stream = &lnbitsStream{
+			cancel:    cancel,
+			connected: make(chan struct{}),
+			done:      make(chan struct{}),
+			waiters:   make(map[string][]chan gjson.Result),
+		}
+		lnbitsStreams[key] = stream
+		go stream.run(ctx, l, key)
+	}
+	stream.waiters[paymentHash] = append(stream.waiters[paymentHash], payments)
+	return stream
+}
+
+// lnbitsUnsubscribe removes a waiter again and closes the stream once nobody
+// waits on it anymore.
+func lnbitsUnsubscribe(l LNBitsParams, stream *lnbitsStream, paymentHash string, payments chan gjson.Result) {
+	lnbitsStreamsMu.Lock()
+	defer lnbitsStreamsMu.Unlock()
+
+	waiters := stream.waiters[paymentHash]
+	for i, waiter := range waiters {
+		if waiter == payments {
+			waiters = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+	if len(waiters) == 0 {
+		delete(stream.waiters, paymentHash)
+	} else {
+		stream.waiters[paymentHash] = waiters
+	}
+
+	if len(stream.waiters) == 0 {
+		stream.cancel()
+		if key := backendKey(l); lnbitsStreams[key] == stream {
+			delete(lnbitsStreams, key)
+		}
+	}
+}
+
+func (stream *lnbitsStream) run(ctx context.Context, l LNBitsParams, key string) {
+	err := stream.read(ctx, l)
+
+	lnbitsStreamsMu.Lock()
+	if lnbitsStreams[key] == stream {
+		delete(lnbitsStreams, key)
+	}
+	stream.err = err
+	lnbitsStreamsMu.Unlock()
+
+	close(stream.done)
+	stream.cancel()
+}
+
+// read passes every payment lnbits streams for the wallet to the waiters of
+// its payment hash, until the stream breaks or is cancelled.
+func (stream *lnbitsStream) read(ctx context.Context, l LNBitsParams) error {
+	// lnbits streams every incoming payment of the wallet as server-sent events
+	req, err := http.NewRequestWithContext(ctx, "GET", l.Host+"/api/v1/payments/sse", nil)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("X-Api-Key", l.Key)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := streamingClient(l).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("call to lnbits failed (%d): %s", resp.StatusCode, responseErrorText(resp))
+	}
+	close(stream.connected)
+
+	var event string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			if event != "payment-received" {
+				continue
+			}
+			payment := gjson.Parse(strings.TrimSpace(strings.TrimPrefix(line, "data:")))
+
+			lnbitsStreamsMu.Lock()
+			for _, waiter := range stream.waiters[payment.Get("payment_hash").String()] {
+				select {
+				case waiter <- payment:
+				default:
+				}
+			}
+			lnbitsStreamsMu.Unlock()
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return errors.New("lnbits payment stream closed")
+}
+
+func (l LNBitsParams) Health() error {
+	_, err := l.call("GET", "/api/v1/wallet", nil)
+	return err
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLNBitsWaitersShareOneStream(t *testing.T) {
+	const waiters = 5
+
+	var mu sync.Mutex
+	streams, lookups := 0, 0
+	events := make(chan string)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/payments/sse" {
+			mu.Lock()
+			lookups++
+			mu.Unlock()
+			fmt.Fprint(w, `{"paid": false}`)
+			return
+		}
+
+		mu.Lock()
+		streams++
+		mu.Unlock()
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case hash := <-events:
+				fmt.Fprintf(w, "event: payment-received\ndata: {\"payment_hash\": %q, \"amount\": 21000}\n\n", hash)
+				w.(http.Flusher).Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	backend := LNBitsParams{Host: server.URL, Key: "key"}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for i := 0; i < waiters; i++ {
+		wg.Add(1)
+		go func(hash string) {
+			defer wg.Done()
+			status, err := backend.WaitInvoice(ctx, hash)
+			if err != nil {
+				t.Errorf("wait %s: %v", hash, err)
+				return
+			}
+			if !status.Paid || status.MSatoshiReceived != 21000 {
+				t.Errorf("wait %s: unexpected status %+v", hash, status)
+			}
+		}(strings.Repeat(fmt.Sprint(i), 64))
+	}
+
+	// every waiter looks its invoice up once it is subscribed
+	for {
+		mu.Lock()
+		subscribed := lookups == waiters
+		mu.Unlock()
+		if subscribed {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	events <- strings.Repeat("9", 64) // not waited for
+	for i := waiters - 1; i >= 0; i-- {
+		events <- strings.Repeat(fmt.Sprint(i), 64)
+	}
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if streams != 1 {
+		t.Fatalf("lnbits saw %d payment streams, expected 1", streams)
+	}
+}
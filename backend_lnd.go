@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+func init() {
+	registerBackendKind("lnd", func(params *Params) BackendParams {
+		return LNDParams{
+			Host:     params.Host,
+			Macaroon: params.Key,
+			Cert:     params.Cert,
+		}
+	})
+}
+
+type LNDParams struct {
+	Cert     string
+	Host     string
+	Macaroon string
+}
+
+func (l LNDParams) getCert() string { return l.Cert }
+func (l LNDParams) isTor() bool {
+	return strings.Contains(l.Host, ".onion")
+}
+
+func (l LNDParams) Capabilities() Capabilities {
+	return Capabilities{
+		DescriptionHash: true,
+		InvoiceLookup:   true,
+	}
+}
+
+// hexMacaroon returns the macaroon hex-encoded, as lnd expects it in the header.
+func (l LNDParams) hexMacaroon() string {
+	// macaroon must be hex, so if it is on base64 we adjust that
+	if b, err := base64.StdEncoding.DecodeString(l.Macaroon); err == nil {
+		return hex.EncodeToString(b)
+	}
+	return l.Macaroon
+}
+
+func (l LNDParams) call(method, path string, body io.Reader) ([]byte, error) {
+	req, err := http.NewRequest(method, l.Host+path, body)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Grpc-Metadata-macaroon", l.hexMacaroon())
+	resp, err := clientFor(l).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("call to lnd failed (%d): %s", resp.StatusCode, responseErrorText(resp))
+	}
+
+	return io.ReadAll(resp.Body)
+}
+
+func (l LNDParams) MakeInvoice(params LNParams) (bolt11 string, err error) {
+	_, b64h := params.descriptionHash()
+
+	body, _ := sjson.Set("{}", "value_msat", params.Msatoshi)
+
+	if params.UseDescriptionHash {
+		body, _ = sjson.Set(body, "description_hash", b64h)
+	} else {
+		body, _ = sjson.Set(body, "memo", params.Description)
+	}
+	if s.LNDprivateOnly {
+		body, _ = sjson.Set(body, "private", true)
+	}
+
+	b, err := l.call("POST", "/v1/invoices", bytes.NewBufferString(body))
+	if err != nil {
+		return "", err
+	}
+
+	return gjson.ParseBytes(b).Get("payment_request").String(), nil
+}
+
+func (l LNDParams) LookupInvoice(paymentHash string) (InvoiceStatus, error) {
+	b, err := l.call("GET", "/v1/invoice/"+paymentHash, nil)
+	if err != nil {
+		return InvoiceStatus{}, err
+	}
+
+	invoice := gjson.ParseBytes(b)
+	if !invoice.Get("settled").Bool() {
+		return InvoiceStatus{}, nil
+	}
+
+	return InvoiceStatus{
+		Paid:             true,
+		PaidAt:           time.Unix(invoice.Get("settle_date").Int(), 0),
+		MSatoshiReceived: invoice.Get("amt_paid_msat").Int(),
+	}, nil
+}
+
+func (l LNDParams) WaitInvoice(ctx context.Context, paymentHash string) (InvoiceStatus, error) {
+	hash, err := hex.DecodeString(paymentHash)
+	if err != nil {
+		return InvoiceStatus{}, err
+	}
+
+	// the subscription first sends the current state of the invoice and then every update
+	req, err := http.NewRequestWithContext(ctx, "GET",
+		l.Host+"/v2/invoices/subscribe/"+base64.URLEncoding.EncodeToString(hash),
+		nil)
+	if err != nil {
+		return InvoiceStatus{}, err
+	}
+
+	req.Header.Set("Grpc-Metadata-macaroon", l.hexMacaroon())
+	resp, err := streamingClient(l).Do(req)
+	if err != nil {
+		return InvoiceStatus{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return InvoiceStatus{}, fmt.Errorf("call to lnd failed (%d): %s", resp.StatusCode, responseErrorText(resp))
+	}
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var update json.RawMessage
+		if err := decoder.Decode(&update); err != nil {
+			return InvoiceStatus{}, err
+		}
+
+		if streamErr := gjson.GetBytes(update, "error.message"); streamErr.Exists() {
+			return InvoiceStatus{}, fmt.Errorf("lnd invoice subscription failed: %s", streamErr.String())
+		}
+
+		invoice := gjson.GetBytes(update, "result")
+		switch invoice.Get("state").String() {
+		case "SETTLED":
+			return InvoiceStatus{
+				Paid:             true,
+				PaidAt:           time.Unix(invoice.Get("settle_date").Int(), 0),
+				MSatoshiReceived: invoice.Get("amt_paid_msat").Int(),
+			}, nil
+		case "CANCELED":
+			return InvoiceStatus{}, errors.New("invoice was canceled")
+		}
+	}
+}
+
+func (l LNDParams) Health() error {
+	// an invoice macaroon can't call getinfo, so we list invoices instead
+	_, err := l.call("GET", "/v1/invoices?num_max_invoices=1", nil)
+	return err
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lnpay/lnpay-go"
+)
+
+func init() {
+	registerBackendKind("lnpay", func(params *Params) BackendParams {
+		return LNPayParams{
+			PublicAccessKey:  params.Pak,
+			WalletInvoiceKey: params.Waki,
+		}
+	})
+}
+
+type LNPayParams struct {
+	PublicAccessKey  string
+	WalletInvoiceKey string
+}
+
+func (l LNPayParams) getCert() string { return "" }
+func (l LNPayParams) isTor() bool     { return false }
+
+func (l LNPayParams) wallet() *lnpay.Wallet {
+	return lnpay.NewClient(l.PublicAccessKey).Wallet(l.WalletInvoiceKey)
+}
+
+func (l LNPayParams) Capabilities() Capabilities {
+	return Capabilities{
+		DescriptionHash: true,
+		InvoiceLookup:   true,
+		MsatoshiStep:    1000,
+	}
+}
+
+func (l LNPayParams) MakeInvoice(params LNParams) (bolt11 string, err error) {
+	bolt11, _, err = l.MakeInvoiceRef(params)
+	return bolt11, err
+}
+
+// MakeInvoiceRef returns the lntx id along with the invoice, since lnpay only
+// lets us fetch a single invoice by that id.
+func (l LNPayParams) MakeInvoiceRef(params LNParams) (bolt11 string, ref string, err error) {
+	hexh, _ := params.descriptionHash()
+
+	lntx, err := l.wallet().Invoice(lnpay.InvoiceParams{
+		NumSatoshis:     params.Msatoshi / 1000,
+		Memo:            params.Description,
+		DescriptionHash: hexh,
+	})
+	if err != nil {
+		return "", "", fmt.Errorf("error creating invoice on lnpay: %w", err)
+	}
+
+	return lntx.PaymentRequest, lntx.ID, nil
+}
+
+func (l LNPayParams) LookupInvoice(paymentHash string) (InvoiceStatus, error) {
+	return InvoiceStatus{}, errors.New("lnpay invoices can only be looked up by their lntx id")
+}
+
+func (l LNPayParams) LookupInvoiceRef(paymentHash string, ref string) (InvoiceStatus, error) {
+	lntx, err := lnpay.NewClient(l.PublicAccessKey).Transaction(ref)
+	if err != nil {
+		return InvoiceStatus{}, fmt.Errorf("error fetching lnpay transaction: %w", err)
+	}
+	if lntx.RHashDecoded != paymentHash {
+		return InvoiceStatus{}, fmt.Errorf("lnpay transaction %s is not for this invoice", ref)
+	}
+	if lntx.Settled != 1 {
+		return InvoiceStatus{}, nil
+	}
+
+	return InvoiceStatus{
+		Paid:             true,
+		PaidAt:           time.Unix(int64(lntx.SettledAt), 0),
+		MSatoshiReceived: lntx.NumSatoshis * 1000,
+	}, nil
+}
+
+// Health only checks that both keys are given. The wallet invoice key can't
+// read the wallet, the test invoice created when the address is saved shows
+// whether the keys work.
+func (l LNPayParams) Health() error {
+	if l.PublicAccessKey == "" || l.WalletInvoiceKey == "" {
+		return errors.New("lnpay needs a public access key and a wallet invoice key")
+	}
+	return nil
+}
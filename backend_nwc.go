@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip04"
+	"github.com/tidwall/gjson"
+)
+
+func init() {
+	registerBackendKind("nwc", func(params *Params) BackendParams {
+		return NWCParams{
+			ConnectionString: params.NWC,
+		}
+	})
+}
+
+// NIP-47 event kinds
+const (
+	nwcKindInfo     = 13194
+	nwcKindRequest  = 23194
+	nwcKindResponse = 23195
+
+	nwcTimeout = 30 * time.Second
+)
+
+// NWCParams talks to a wallet service over Nostr Wallet Connect (NIP-47).
+// The connection string has the form
+// nostr+walletconnect://<wallet pubkey>?relay=<relay url>&secret=<client secret key>
+type NWCParams struct {
+	ConnectionString string
+}
+
+type nwcConnection struct {
+	walletPubkey string
+	relay        string
+	secret       string
+}
+
+func parseNWCConnectionString(connectionString string) (nwcConnection, error) {
+	u, err := url.Parse(connectionString)
+	if err != nil {
+		return nwcConnection{}, fmt.Errorf("invalid nwc connection string: %w", err)
+	}
+	if u.Scheme != "nostr+walletconnect" && u.Scheme != "nostrwalletconnect" {
+		return nwcConnection{}, errors.New("nwc connection string must start with nostr+walletconnect://")
+	}
+
+	// the pubkey ends up as host or opaque part depending on the number of slashes
+	conn := nwcConnection{
+		walletPubkey: u.Host,
+		relay:        u.Query().Get("relay"),
+		secret:       u.Query().Get("secret"),
+	}
+	if conn.walletPubkey == "" {
+		conn.walletPubkey = strings.TrimPrefix(u.Opaque, "//")
+	}
+
+	if !nostr.IsValidPublicKeyHex(conn.walletPubkey) {
+		return nwcConnection{}, errors.New("nwc connection string has an invalid wallet pubkey")
+	}
+	if conn.relay == "" {
+		return nwcConnection{}, errors.New("nwc connection string has no relay")
+	}
+	if _, err := nostr.GetPublicKey(conn.secret); err != nil {
+		return nwcConnection{}, errors.New("nwc connection string has an invalid secret")
+	}
+	return conn, nil
+}
+
+// nwcWallet is the relay connection we keep open for one wallet, so polling
+// its invoices doesn't open a new websocket for every lookup.
+type nwcWallet struct {
+	mu    sync.Mutex
+	relay *nostr.Relay
+}
+
+var (
+	nwcWalletsMu sync.Mutex
+	nwcWallets   = make(map[string]*nwcWallet) // by connection string
+)
+
+// nwcRelay returns the open relay connection of a wallet, connecting again if
+// there is none yet or the last one was dropped. The wallet stays locked
+// until unlock is called.
+func nwcRelay(connectionString string, conn nwcConnection) (relay *nostr.Relay, unlock func(), err error) {
+	nwcWalletsMu.Lock()
+	wallet, ok := nwcWallets[connectionString]
+	if !ok {
+		wallet = &nwcWallet{}
+		nwcWallets[connectionString] = wallet
+	}
+	nwcWalletsMu.Unlock()
+
+	wallet.mu.Lock()
+	if wallet.relay == nil || wallet.relay.ConnectionContext.Err() != nil {
+		// not tied to the request context, the connection outlives the request
+		relay, err := nostr.RelayConnect(context.Background(), conn.relay)
+		if err != nil {
+			wallet.mu.Unlock()
+			return nil, nil, fmt.Errorf("couldn't connect to nwc relay %s: %w", conn.relay, err)
+		}
+		wallet.relay = relay
+	}
+	return wallet.relay, wallet.mu.Unlock, nil
+}
+
+func (l NWCParams) getCert() string { return "" }
+func (l NWCParams) isTor() bool     { return false }
+
+func (l NWCParams) Capabilities() Capabilities {
+	return Capabilities{
+		DescriptionHash: true,
+		InvoiceLookup:   true,
+	}
+}
+
+// request sends a single NIP-47 request to the wallet service and waits for its result.
+func (l NWCParams) request(method string, params map[string]interface{}) (gjson.Result, error) {
+	conn, err := parseNWCConnectionString(l.ConnectionString)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), nwcTimeout)
+	defer cancel()
+
+	sharedSecret, err := nip04.ComputeSharedSecret(conn.walletPubkey, conn.secret)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+
+	payload, _ := json.Marshal(map[string]interface{}{
+		"method": method,
+		"params": params,
+	})
+	content, err := nip04.Encrypt(string(payload), sharedSecret)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+
+	request := nostr.Event{
+		CreatedAt: time.Now(),
+		Kind:      nwcKindRequest,
+		Tags:      nostr.Tags{nostr.Tag{"p", conn.walletPubkey}},
+		Content:   content,
+	}
+	if err := request.Sign(conn.secret); err != nil {
+		return gjson.Result{}, err
+	}
+
+	// requests share the connection, but go-nostr numbers subscriptions
+	// without a lock, so only one request sets up its subscription at a time
+	relay, unlock, err := nwcRelay(l.ConnectionString, conn)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+
+	// subscribe before publishing so we can't miss a quick response
+	sub, err := relay.Subscribe(ctx, nostr.Filters{{
+		Kinds:   []int{nwcKindResponse},
+		Authors: []string{conn.walletPubkey},
+		Tags:    nostr.TagMap{"e": []string{request.ID}},
+	}})
+	if err != nil {
+		unlock()
+		return gjson.Result{}, fmt.Errorf("couldn't subscribe to nwc relay: %w", err)
+	}
+	defer func() {
+		// a late event would otherwise block the reader of the shared connection
+		go func() {
+			for range sub.Events {
+			}
+		}()
+		sub.Unsub()
+	}()
+
+	status, err := relay.Publish(ctx, request)
+	unlock()
+	if status == nostr.PublishStatusFailed {
+		return gjson.Result{}, fmt.Errorf("nwc relay rejected request: %v", err)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return gjson.Result{}, fmt.Errorf("no %s response from nwc wallet service", method)
+		case response, ok := <-sub.Events:
+			if !ok {
+				return gjson.Result{}, errors.New("nwc relay closed the subscription")
+			}
+			if valid, _ := response.CheckSignature(); !valid {
+				continue
+			}
+
+			plain, err := nip04.Decrypt(response.Content, sharedSecret)
+			if err != nil {
+				return gjson.Result{}, fmt.Errorf("couldn't decrypt nwc response: %w", err)
+			}
+
+			result := gjson.Parse(plain)
+			if message := result.Get("error.message"); message.Exists() {
+				return gjson.Result{}, fmt.Errorf("nwc %s failed (%s): %s",
+					method, result.Get("error.code").String(), message.String())
+			}
+			return result.Get("result"), nil
+		}
+	}
+}
+
+func (l NWCParams) MakeInvoice(params LNParams) (bolt11 string, err error) {
+	hexh, _ := params.descriptionHash()
+
+	invoiceParams := map[string]interface{}{
+		"amount": params.Msatoshi,
+	}
+	if params.UseDescriptionHash {
+		invoiceParams["description_hash"] = hexh
+	} else {
+		invoiceParams["description"] = params.Description
+	}
+
+	result, err := l.request("make_invoice", invoiceParams)
+	if err != nil {
+		return "", err
+	}
+
+	invoice := result.Get("invoice")
+	if invoice.Type != gjson.String {
+		return "", fmt.Errorf("no invoice found in make_invoice response, got %v", result)
+	}
+	return invoice.String(), nil
+}
+
+func (l NWCParams) LookupInvoice(paymentHash string) (InvoiceStatus, error) {
+	result, err := l.request("lookup_invoice", map[string]interface{}{
+		"payment_hash": paymentHash,
+	})
+	if err != nil {
+		return InvoiceStatus{}, err
+	}
+
+	// older wallet services don't report a state, only settled_at
+	settledAt := result.Get("settled_at").Int()
+	if result.Get("state").String() != "settled" && settledAt == 0 {
+		return InvoiceStatus{}, nil
+	}
+
+	status := InvoiceStatus{
+		Paid:             true,
+		PaidAt:           time.Now(),
+		MSatoshiReceived: result.Get("amount").Int(),
+	}
+	if settledAt != 0 {
+		status.PaidAt = time.Unix(settledAt, 0)
+	}
+	return status, nil
+}
+
+// Health checks that the wallet service announces itself on the relay and
+// supports the methods we need.
+func (l NWCParams) Health() error {
+	conn, err := parseNWCConnectionString(l.ConnectionString)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), nwcTimeout)
+	defer cancel()
+
+	relay, unlock, err := nwcRelay(l.ConnectionString, conn)
+	if err != nil {
+		return err
+	}
+	infos, err := relay.QuerySync(ctx, nostr.Filter{
+		Kinds:   []int{nwcKindInfo},
+		Authors: []string{conn.walletPubkey},
+		Limit:   1,
+	})
+	unlock()
+	if err != nil {
+		return fmt.Errorf("couldn't query nwc relay: %w", err)
+	}
+	if len(infos) == 0 {
+		return fmt.Errorf("no nwc wallet service found on %s", conn.relay)
+	}
+
+	methods := strings.Fields(infos[0].Content)
+	for _, needed := range []string{"make_invoice", "lookup_invoice"} {
+		found := false
+		for _, method := range methods {
+			if method == needed {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("nwc wallet service doesn't support %s", needed)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,259 @@
+// go-nostr v0.16's Relay.Publish races with its own OK handler, so this
+// test can't run under the race detector.
+
+//go:build !race
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip04"
+	"github.com/tidwall/gjson"
+)
+
+// testRelay is a minimal in-memory nostr relay. It keeps every event and
+// counts the websocket connections it accepted.
+type testRelay struct {
+	mu          sync.Mutex
+	events      []nostr.Event
+	subs        map[*testRelayClient]map[string]nostr.Filters
+	connections int
+}
+
+type testRelayClient struct {
+	mu   sync.Mutex
+	conn *websocket.Conn
+}
+
+func (c *testRelayClient) send(message ...interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn.WriteJSON(message)
+}
+
+func (relay *testRelay) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	client := &testRelayClient{conn: conn}
+
+	relay.mu.Lock()
+	relay.connections++
+	relay.subs[client] = make(map[string]nostr.Filters)
+	relay.mu.Unlock()
+
+	defer func() {
+		relay.mu.Lock()
+		delete(relay.subs, client)
+		relay.mu.Unlock()
+		conn.Close()
+	}()
+
+	for {
+		var message []json.RawMessage
+		if err := conn.ReadJSON(&message); err != nil {
+			return
+		}
+		if len(message) < 2 {
+			continue
+		}
+		var command string
+		json.Unmarshal(message[0], &command)
+
+		switch command {
+		case "EVENT":
+			var event nostr.Event
+			json.Unmarshal(message[1], &event)
+			client.send("OK", event.ID, true, "")
+
+			relay.mu.Lock()
+			relay.events = append(relay.events, event)
+			for other, subs := range relay.subs {
+				for id, filters := range subs {
+					if filters.Match(&event) {
+						go other.send("EVENT", id, event)
+					}
+				}
+			}
+			relay.mu.Unlock()
+		case "REQ":
+			var id string
+			json.Unmarshal(message[1], &id)
+			var filters nostr.Filters
+			for _, raw := range message[2:] {
+				var filter nostr.Filter
+				json.Unmarshal(raw, &filter)
+				filters = append(filters, filter)
+			}
+
+			relay.mu.Lock()
+			relay.subs[client][id] = filters
+			var stored []nostr.Event
+			for _, event := range relay.events {
+				if filters.Match(&event) {
+					stored = append(stored, event)
+				}
+			}
+			relay.mu.Unlock()
+
+			for _, event := range stored {
+				client.send("EVENT", id, event)
+			}
+			client.send("EOSE", id)
+		case "CLOSE":
+			var id string
+			json.Unmarshal(message[1], &id)
+			relay.mu.Lock()
+			delete(relay.subs[client], id)
+			relay.mu.Unlock()
+		}
+	}
+}
+
+// fakeWalletService answers NIP-47 requests from one client. Invoices it
+// makes are settled once they were looked up twice.
+func fakeWalletService(t *testing.T, relayURL, walletSecret, clientPubkey string) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	relay, err := nostr.RelayConnect(ctx, relayURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { relay.Close() })
+
+	walletPubkey, _ := nostr.GetPublicKey(walletSecret)
+	info := nostr.Event{
+		CreatedAt: time.Now(),
+		Kind:      nwcKindInfo,
+		Content:   "get_info make_invoice lookup_invoice",
+	}
+	info.Sign(walletSecret)
+	if _, err := relay.Publish(ctx, info); err != nil {
+		t.Fatal(err)
+	}
+
+	sub, err := relay.Subscribe(ctx, nostr.Filters{{
+		Kinds:   []int{nwcKindRequest},
+		Authors: []string{clientPubkey},
+		Tags:    nostr.TagMap{"p": []string{walletPubkey}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sharedSecret, _ := nip04.ComputeSharedSecret(clientPubkey, walletSecret)
+	lookups := make(map[string]int)
+	go func() {
+		for request := range sub.Events {
+			plain, err := nip04.Decrypt(request.Content, sharedSecret)
+			if err != nil {
+				continue
+			}
+			parsed := gjson.Parse(plain)
+
+			var response interface{}
+			switch parsed.Get("method").String() {
+			case "make_invoice":
+				response = map[string]interface{}{
+					"result_type": "make_invoice",
+					"result": map[string]interface{}{
+						"invoice": fmt.Sprintf("lnbcrt%dn1fake", parsed.Get("params.amount").Int()/100),
+					},
+				}
+			case "lookup_invoice":
+				hash := parsed.Get("params.payment_hash").String()
+				lookups[hash]++
+				result := map[string]interface{}{"state": "pending", "amount": 21000}
+				if lookups[hash] > 2 {
+					result["state"] = "settled"
+					result["settled_at"] = 1700000000
+				}
+				response = map[string]interface{}{"result_type": "lookup_invoice", "result": result}
+			default:
+				response = map[string]interface{}{
+					"error": map[string]interface{}{"code": "NOT_IMPLEMENTED", "message": "unknown method"},
+				}
+			}
+
+			payload, _ := json.Marshal(response)
+			content, _ := nip04.Encrypt(string(payload), sharedSecret)
+			event := nostr.Event{
+				CreatedAt: time.Now(),
+				Kind:      nwcKindResponse,
+				Tags:      nostr.Tags{{"p", clientPubkey}, {"e", request.ID}},
+				Content:   content,
+			}
+			event.Sign(walletSecret)
+			relay.Publish(ctx, event)
+		}
+	}()
+}
+
+func TestNWCReusesRelayConnection(t *testing.T) {
+	relay := &testRelay{subs: make(map[*testRelayClient]map[string]nostr.Filters)}
+	server := httptest.NewServer(relay)
+	t.Cleanup(server.Close)
+	relayURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	walletSecret := nostr.GeneratePrivateKey()
+	walletPubkey, _ := nostr.GetPublicKey(walletSecret)
+	clientSecret := nostr.GeneratePrivateKey()
+	clientPubkey, _ := nostr.GetPublicKey(clientSecret)
+	fakeWalletService(t, relayURL, walletSecret, clientPubkey)
+
+	backend := NWCParams{ConnectionString: fmt.Sprintf(
+		"nostr+walletconnect://%s?relay=%s&secret=%s", walletPubkey, relayURL, clientSecret)}
+
+	if err := backend.Health(); err != nil {
+		t.Fatalf("health: %v", err)
+	}
+
+	bolt11, err := backend.MakeInvoice(LNParams{
+		Msatoshi:           21000,
+		Description:        "zap",
+		UseDescriptionHash: true,
+	})
+	if err != nil {
+		t.Fatalf("make invoice: %v", err)
+	}
+	if bolt11 != "lnbcrt210n1fake" {
+		t.Fatalf("unexpected invoice %s", bolt11)
+	}
+
+	hash := "f0e4c2f76c58916ec258f246851bea091d14d4247a2fc3e18694461b1816e13b"
+	for i := 1; i <= 3; i++ {
+		status, err := backend.LookupInvoice(hash)
+		if err != nil {
+			t.Fatalf("lookup %d: %v", i, err)
+		}
+		if status.Paid != (i == 3) {
+			t.Fatalf("lookup %d: paid is %v", i, status.Paid)
+		}
+		if status.Paid && (status.MSatoshiReceived != 21000 || status.PaidAt.Unix() != 1700000000) {
+			t.Fatalf("unexpected settled status %+v", status)
+		}
+	}
+
+	// one connection for the wallet service, one for all of our requests
+	relay.mu.Lock()
+	connections := relay.connections
+	relay.mu.Unlock()
+	if connections != 2 {
+		t.Fatalf("relay saw %d connections, expected 2", connections)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+func init() {
+	registerBackendKind("phoenixd", func(params *Params) BackendParams {
+		return PhoenixdParams{
+			Host:     strings.TrimSuffix(params.Host, "/"),
+			Password: params.Password,
+			Cert:     params.Cert,
+		}
+	})
+}
+
+// PhoenixdParams talks to the phoenixd http api, which authenticates with the
+// http-password from its phoenix.conf and an empty username.
+type PhoenixdParams struct {
+	Cert     string
+	Host     string
+	Password string
+}
+
+func (l PhoenixdParams) getCert() string { return l.Cert }
+func (l PhoenixdParams) isTor() bool {
+	return strings.Contains(l.Host, ".onion")
+}
+
+func (l PhoenixdParams) Capabilities() Capabilities {
+	return Capabilities{
+		DescriptionHash: true,
+		InvoiceLookup:   true,
+		MsatoshiStep:    1000,
+	}
+}
+
+func (l PhoenixdParams) call(method, path string, form url.Values) ([]byte, error) {
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+
+	req, err := http.NewRequest(method, l.Host+path, body)
+	if err != nil {
+		return nil, err
+	}
+
+	req.SetBasicAuth("", l.Password)
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	resp, err := clientFor(l).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		return nil, errWrongPassword
+	}
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("call to phoenixd failed (%d): %s", resp.StatusCode, responseErrorText(resp))
+	}
+
+	return io.ReadAll(resp.Body)
+}
+
+func (l PhoenixdParams) MakeInvoice(params LNParams) (bolt11 string, err error) {
+	hexh, _ := params.descriptionHash()
+
+	// phoenixd only takes whole satoshis
+	form := url.Values{}
+	form.Set("amountSat", strconv.FormatInt(params.Msatoshi/1000, 10))
+	if params.UseDescriptionHash {
+		form.Set("descriptionHash", hexh)
+	} else if params.Description == "" {
+		form.Set("description", "created by makeinvoice")
+	} else {
+		form.Set("description", params.Description)
+	}
+	if params.Label != "" {
+		form.Set("externalId", params.Label)
+	}
+
+	b, err := l.call("POST", "/createinvoice", form)
+	if err != nil {
+		return "", err
+	}
+
+	invoice := gjson.ParseBytes(b).Get("serialized")
+	if invoice.Type != gjson.String {
+		return "", fmt.Errorf("no serialized invoice found in phoenixd response, got %s", string(b))
+	}
+	return invoice.String(), nil
+}
+
+func (l PhoenixdParams) LookupInvoice(paymentHash string) (InvoiceStatus, error) {
+	b, err := l.call("GET", "/payments/incoming/"+url.PathEscape(paymentHash), nil)
+	if err != nil {
+		return InvoiceStatus{}, err
+	}
+
+	payment := gjson.ParseBytes(b)
+	if !payment.Get("isPaid").Bool() {
+		return InvoiceStatus{}, nil
+	}
+
+	status := InvoiceStatus{
+		Paid:             true,
+		PaidAt:           time.Now(),
+		MSatoshiReceived: payment.Get("receivedSat").Int() * 1000,
+	}
+	if completedAt := payment.Get("completedAt").Int(); completedAt != 0 {
+		status.PaidAt = time.UnixMilli(completedAt)
+	}
+	return status, nil
+}
+
+func (l PhoenixdParams) Health() error {
+	_, err := l.call("GET", "/getinfo", nil)
+	return err
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"sync"
+)
+
+func init() {
+	registerBackendKind("pool", func(params *Params) BackendParams {
+		return PoolParams{
+			Members: len(params.Backends),
+		}
+	})
+}
+
+// PoolParams is used by addresses shared by several people. The pool itself
+// never issues invoices, its members in Backends take turns by weight.
+type PoolParams struct {
+	Members int
+}
+
+func (l PoolParams) getCert() string { return "" }
+func (l PoolParams) isTor() bool     { return false }
+
+func (l PoolParams) Capabilities() Capabilities {
+	return Capabilities{
+		DescriptionHash: false,
+		InvoiceLookup:   false,
+	}
+}
+
+func (l PoolParams) MakeInvoice(params LNParams) (bolt11 string, err error) {
+	return "", errors.New("pool addresses issue invoices through their members")
+}
+
+func (l PoolParams) LookupInvoice(paymentHash string) (InvoiceStatus, error) {
+	return InvoiceStatus{}, errLookupUnsupported
+}
+
+func (l PoolParams) Health() error {
+	if l.Members == 0 {
+		return errors.New("pool addresses need at least one member in backends")
+	}
+	return nil
+}
+
+// round-robin state of each pool address, by id. It starts over on restart,
+// which only shifts whose turn it is.
+var (
+	poolTurnsMu sync.Mutex
+	poolTurns   = make(map[string][]int)
+)
+
+// nextPoolMember picks the member whose turn it is with smooth weighted
+// round-robin and returns its index in backendConfigs. Unset weights count as 1.
+func (params *Params) nextPoolMember() int {
+	id := getID(params.Name, params.Domain)
+
+	poolTurnsMu.Lock()
+	defer poolTurnsMu.Unlock()
+
+	current := poolTurns[id]
+	if len(current) != len(params.Backends) {
+		current = make([]int, len(params.Backends))
+		poolTurns[id] = current
+	}
+
+	total := 0
+	best := 0
+	for i, member := range params.Backends {
+		weight := member.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		current[i] += weight
+		total += weight
+		if current[i] > current[best] {
+			best = i
+		}
+	}
+	current[best] -= total
+
+	return best + 1
+}
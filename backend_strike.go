@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+func init() {
+	registerBackendKind("strike", func(params *Params) BackendParams {
+		currency := strings.ToUpper(params.Currency)
+		if currency == "" {
+			currency = "BTC"
+		}
+		return StrikeParams{
+			Key:      params.Key,
+			Username: params.Username,
+			Currency: currency,
+		}
+	})
+}
+
+type StrikeParams struct {
+	Key      string
+	Username string
+	Currency string
+}
+
+func (l StrikeParams) getCert() string { return "" }
+func (l StrikeParams) isTor() bool     { return false }
+
+func (l StrikeParams) Capabilities() Capabilities {
+	return Capabilities{
+		DescriptionHash: false,
+		InvoiceLookup:   true,
+		MsatoshiStep:    1000,
+	}
+}
+
+func (l StrikeParams) MakeInvoice(params LNParams) (bolt11 string, err error) {
+	bolt11, _, err = l.MakeInvoiceRef(params)
+	return bolt11, err
+}
+
+// MakeInvoiceRef returns the strike invoice id along with the bolt11, since
+// strike invoices can only be fetched by their own id.
+func (l StrikeParams) MakeInvoiceRef(params LNParams) (bolt11 string, ref string, err error) {
+	// the amount is given in BTC, so only whole satoshis can be invoiced
+	if params.Msatoshi%1000 != 0 {
+		return "", "", errors.New("strike only accepts whole satoshi amounts")
+	}
+	sats := params.Msatoshi / 1000
+
+	payload := struct {
+		Description string `json:"description"`
+		Amount      struct {
+			Currency string `json:"currency"`
+			Amount   string `json:"amount"`
+		} `json:"amount"`
+	}{}
+
+	payload.Description = "created by makeinvoice"
+	if params.Description != "" {
+		payload.Description = params.Description
+	}
+
+	payload.Amount.Currency = "BTC"
+	payload.Amount.Amount = fmt.Sprintf("%d.%08d", sats/100000000, sats%100000000)
+
+	jpayload, err := json.Marshal(payload)
+	if err != nil {
+		return "", "", err
+	}
+
+	body, err := l.call("POST", "/invoices/handle/"+l.Username, jpayload)
+	if err != nil {
+		return "", "", err
+	}
+	invoiceId := gjson.ParseBytes(body).Get("invoiceId").String()
+	if invoiceId == "" {
+		return "", "", fmt.Errorf("no invoiceId found in strike response, got %s", string(body))
+	}
+
+	// got strike invoice - get actual LN invoice now. sigh.
+	body, err = l.call("POST", "/invoices/"+invoiceId+"/quote", nil)
+	if err != nil {
+		return "", "", err
+	}
+	lnInvoice := gjson.ParseBytes(body).Get("lnInvoice").String()
+	if lnInvoice == "" {
+		return "", "", fmt.Errorf("no lnInvoice found in strike quote, got %s", string(body))
+	}
+
+	return lnInvoice, invoiceId, nil
+}
+
+func (l StrikeParams) call(method, path string, payload []byte) ([]byte, error) {
+	var body io.Reader
+	if payload != nil {
+		body = bytes.NewReader(payload)
+	}
+
+	req, err := http.NewRequest(method, "https://api.strike.me/v1"+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if payload != nil {
+		req.Header.Add("Content-Type", "application/json")
+	}
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("Authorization", "Bearer "+l.Key)
+
+	resp, err := clientFor(l).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("call to strike failed (%d): %s", resp.StatusCode, responseErrorText(resp))
+	}
+
+	return io.ReadAll(resp.Body)
+}
+
+func (l StrikeParams) LookupInvoice(paymentHash string) (InvoiceStatus, error) {
+	return InvoiceStatus{}, errors.New("strike invoices can only be looked up by their invoice id")
+}
+
+func (l StrikeParams) LookupInvoiceRef(paymentHash string, ref string) (InvoiceStatus, error) {
+	body, err := l.call("GET", "/invoices/"+url.PathEscape(ref), nil)
+	if err != nil {
+		return InvoiceStatus{}, err
+	}
+
+	if gjson.ParseBytes(body).Get("state").String() != "PAID" {
+		return InvoiceStatus{}, nil
+	}
+
+	return InvoiceStatus{
+		Paid:   true,
+		PaidAt: time.Now(),
+	}, nil
+}
+
+// Health checks that the api key can see the account and that the account can
+// receive invoices in the configured currency.
+func (l StrikeParams) Health() error {
+	if l.Username == "" {
+		return errors.New("missing strike username")
+	}
+	// invoices in other currencies wouldn't be for the amount the payer asked for
+	if l.Currency != "BTC" {
+		return fmt.Errorf("strike invoices must be in BTC, not %s", l.Currency)
+	}
+
+	body, err := l.call("GET", "/accounts/handle/"+l.Username+"/profile", nil)
+	if err != nil {
+		return err
+	}
+
+	profile := gjson.ParseBytes(body)
+	if !profile.Get("canReceive").Bool() {
+		return fmt.Errorf("strike account %s can't receive payments", l.Username)
+	}
+	for _, currency := range profile.Get("currencies").Array() {
+		if currency.Get("currency").String() == l.Currency && currency.Get("isInvoiceable").Bool() {
+			return nil
+		}
+	}
+	return fmt.Errorf("strike account %s can't be invoiced in %s", l.Username, l.Currency)
+}
@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+func TestBackendTransportVerifiesHostedServices(t *testing.T) {
+	hosted := []BackendParams{
+		StrikeParams{Key: "key", Username: "name", Currency: "BTC"},
+		LNDHubParams{Host: "https://hub.example.com", Login: "login", Password: "password"},
+		BTCPayParams{Host: "https://btcpay.example.com", Key: "key", StoreId: "store"},
+		CustomParams{},
+		CashuParams{Mint: "https://mint.example.com"},
+	}
+	for _, backend := range hosted {
+		config := backendTransport(backend).TLSClientConfig
+		if config != nil && config.InsecureSkipVerify {
+			t.Errorf("%T doesn't verify TLS", backend)
+		}
+	}
+
+	// self-hosted nodes usually have self-signed certs
+	if config := backendTransport(LNDParams{Host: "https://node.example.com"}).TLSClientConfig; config == nil || !config.InsecureSkipVerify {
+		t.Error("LNDParams without a cert verifies TLS")
+	}
+}
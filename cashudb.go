@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/cockroachdb/pebble"
+	jsoniter "github.com/json-iterator/go"
+)
+
+// cashuDb holds the mint quotes of cashu invoices and the ecash minted for
+// each address until its owner redeems it. Losing it means losing funds.
+var cashuDb *pebble.DB
+
+// serializes read-modify-write of the stored proofs
+var cashuProofsMu sync.Mutex
+
+type CashuQuote struct {
+	PaymentHash string `json:"payment_hash"`
+	Mint        string `json:"mint"`
+	Quote       string `json:"quote"`
+	Amount      int64  `json:"amount"`
+	Owner       string `json:"owner"`
+
+	// set once we ask the mint to sign, kept until the proofs are stored
+	KeysetId string        `json:"keyset_id,omitempty"`
+	Outputs  []CashuOutput `json:"outputs,omitempty"`
+}
+
+// CashuOutput is a blinded message sent to the mint, with the secret and
+// blinding factor needed to turn its signature into a proof.
+type CashuOutput struct {
+	Amount int64  `json:"amount"`
+	Secret string `json:"secret"`
+	R      string `json:"r"`
+	B_     string `json:"B_"`
+}
+
+type CashuProof struct {
+	Amount int64  `json:"amount"`
+	Id     string `json:"id"`
+	Secret string `json:"secret"`
+	C      string `json:"C"`
+}
+
+type CashuMintProofs struct {
+	Mint   string       `json:"mint"`
+	Proofs []CashuProof `json:"proofs"`
+}
+
+func SaveCashuQuote(quote CashuQuote) error {
+	data, err := jsoniter.Marshal(quote)
+	if err != nil {
+		return err
+	}
+	return cashuDb.Set([]byte("quote/"+quote.PaymentHash), data, pebble.Sync)
+}
+
+func GetCashuQuote(paymentHash string) (CashuQuote, error) {
+	val, closer, err := cashuDb.Get([]byte("quote/" + paymentHash))
+	if err != nil {
+		if errors.Is(err, pebble.ErrNotFound) {
+			return CashuQuote{}, errors.New("unknown cashu quote")
+		}
+		return CashuQuote{}, err
+	}
+	defer closer.Close()
+
+	var quote CashuQuote
+	err = jsoniter.Unmarshal(val, &quote)
+	return quote, err
+}
+
+func AddCashuProofs(owner, mint string, proofs []CashuProof) error {
+	cashuProofsMu.Lock()
+	defer cashuProofsMu.Unlock()
+
+	data, err := withCashuProofs(owner, mint, proofs)
+	if err != nil {
+		return err
+	}
+	return cashuDb.Set([]byte("proofs/"+owner), data, pebble.Sync)
+}
+
+// StoreCashuMint adds the proofs minted for a quote to its owner and removes
+// the quote in one write, so they are stored exactly once.
+func StoreCashuMint(quote CashuQuote, proofs []CashuProof) error {
+	cashuProofsMu.Lock()
+	defer cashuProofsMu.Unlock()
+
+	data, err := withCashuProofs(quote.Owner, quote.Mint, proofs)
+	if err != nil {
+		return err
+	}
+
+	batch := cashuDb.NewBatch()
+	defer batch.Close()
+	if err := batch.Set([]byte("proofs/"+quote.Owner), data, nil); err != nil {
+		return err
+	}
+	if err := batch.Delete([]byte("quote/"+quote.PaymentHash), nil); err != nil {
+		return err
+	}
+	return batch.Commit(pebble.Sync)
+}
+
+// withCashuProofs returns the stored proofs of owner with proofs added.
+func withCashuProofs(owner, mint string, proofs []CashuProof) ([]byte, error) {
+	stored, err := getCashuProofs(owner)
+	if err != nil {
+		return nil, err
+	}
+
+	found := false
+	for i := range stored {
+		if stored[i].Mint == mint {
+			stored[i].Proofs = append(stored[i].Proofs, proofs...)
+			found = true
+		}
+	}
+	if !found {
+		stored = append(stored, CashuMintProofs{Mint: mint, Proofs: proofs})
+	}
+	return jsoniter.Marshal(stored)
+}
+
+func GetCashuProofs(owner string) ([]CashuMintProofs, error) {
+	cashuProofsMu.Lock()
+	defer cashuProofsMu.Unlock()
+
+	return getCashuProofs(owner)
+}
+
+// CashuBalance sums the stored proofs of owner, in satoshis.
+func CashuBalance(owner string) (int64, error) {
+	stored, err := GetCashuProofs(owner)
+	if err != nil {
+		return 0, err
+	}
+
+	var balance int64
+	for _, mint := range stored {
+		for _, proof := range mint.Proofs {
+			balance += proof.Amount
+		}
+	}
+	return balance, nil
+}
+
+// TakeCashuProofs returns all proofs stored for owner and removes them.
+func TakeCashuProofs(owner string) ([]CashuMintProofs, error) {
+	cashuProofsMu.Lock()
+	defer cashuProofsMu.Unlock()
+
+	stored, err := getCashuProofs(owner)
+	if err != nil || len(stored) == 0 {
+		return stored, err
+	}
+	return stored, cashuDb.Delete([]byte("proofs/"+owner), pebble.Sync)
+}
+
+func getCashuProofs(owner string) ([]CashuMintProofs, error) {
+	val, closer, err := cashuDb.Get([]byte("proofs/" + owner))
+	if err != nil {
+		if errors.Is(err, pebble.ErrNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer closer.Close()
+
+	var stored []CashuMintProofs
+	err = jsoniter.Unmarshal(val, &stored)
+	return stored, err
+}
@@ -8,6 +8,8 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/cockroachdb/pebble"
 	jsoniter "github.com/json-iterator/go"
@@ -24,6 +26,46 @@ type Params struct {
 	NodeId string `json:"nodeid"`
 	Rune   string `json:"rune"`
 
+	// strike
+	Username string `json:"username"`
+	Currency string `json:"currency"`
+
+	// nostr wallet connect
+	NWC string `json:"nwc"`
+
+	// lndhub, password also for phoenixd and eclair
+	Login    string `json:"login"`
+	Password string `json:"password"`
+
+	// btcpay
+	StoreId string `json:"storeid"`
+
+	// custom
+	CustomInvoice *CustomRequest `json:"custom_invoice,omitempty"`
+	CustomStatus  *CustomRequest `json:"custom_status,omitempty"`
+
+	// cashu
+	Mint string `json:"mint"`
+
+	// PEM certificate or sha256 fingerprint the node's TLS cert is verified
+	// against, without one self-hosted nodes aren't verified at all and
+	// everything else is verified against the system roots
+	Cert string `json:"cert,omitempty"`
+
+	// seconds to wait for this backend to create an invoice before trying
+	// the next one, 0 means the client timeout
+	Timeout int `json:"timeout,omitempty"`
+
+	// share of invoices this backend gets as a pool member, unset means 1
+	Weight int `json:"weight,omitempty"`
+
+	// further backends, tried in order when the one above fails. Only their
+	// backend fields are used
+	Backends []Params `json:"backends,omitempty"`
+
+	// pick the backend to use first depending on the payment
+	Rules []RoutingRule `json:"rules,omitempty"`
+
 	Pin              string `json:"pin"`
 	MinSendable      string `json:"minSendable"`
 	MaxSendable      string `json:"maxSendable"`
@@ -45,7 +87,7 @@ func SaveName(
 	providedPin string,
 	overwrite bool,
 	previousname string,
-) (pin string, inv string, err error) {
+) (pin string, inv string, warnings []string, err error) {
 	name = strings.ToLower(name)
 	domain = strings.ToLower(domain)
 
@@ -67,38 +109,122 @@ func SaveName(
 	if _, closer, err := db.Get(key); err == nil {
 		defer closer.Close()
 		if pin != providedPin {
-			return "", "", errors.New("name already exists! must provide pin")
+			return "", "", nil, errors.New("name already exists! must provide pin")
 		}
 	}
 	if err != nil {
-		return "", "", errors.New("that name does not exist")
+		return "", "", nil, errors.New("that name does not exist")
 	}
 
 	if overwrite {
+		// the ecash is stored under the previous name, whoever takes it next would get it
+		if balance, err := CashuBalance(getID(previousname, domain)); err != nil {
+			return "", "", nil, err
+		} else if balance > 0 && getID(previousname, domain) != string(key) {
+			return "", "", nil, fmt.Errorf("%s@%s still has %d sat of ecash, redeem it first", previousname, domain, balance)
+		}
+
 		previouskey := []byte(getID(previousname, domain))
 		if err := db.Delete(previouskey, pebble.Sync); err != nil {
-			return "", "", fmt.Errorf("couldn't delete previous entry: %w", err)
+			return "", "", nil, fmt.Errorf("couldn't delete previous entry: %w", err)
 		}
 	}
 
 	params.Name = name
 	params.Domain = domain
 
+	if err := params.validateRules(); err != nil {
+		return "", "", nil, err
+	}
+	for index, config := range params.backendConfigs() {
+		if config.Cert == "" {
+			continue
+		}
+		if _, err := certTLSConfig(config.Cert); err != nil {
+			if index == 0 {
+				return "", "", nil, fmt.Errorf("invalid cert: %w", err)
+			}
+			return "", "", nil, fmt.Errorf("invalid cert for backend %d: %w", index, err)
+		}
+	}
+
 	if params.Kind != "forward" {
-		// check if the given data works
-		if inv, err = makeInvoice(params, 1000, &pin, "", ""); err != nil {
-			return "", "", fmt.Errorf("couldn't make an invoice with the given data: %w", err)
+		// check if the given data works, the backends are checked at once so
+		// saving doesn't take longer than the slowest of them
+		configs := params.backendConfigs()
+		backends := make([]BackendParams, len(configs))
+		for index, config := range configs {
+			if backends[index], err = backendFromParams(config); err != nil {
+				return "", "", nil, err
+			}
+		}
+
+		healthErrs := make([]error, len(configs))
+		var wg sync.WaitGroup
+		for index := range backends {
+			wg.Add(1)
+			go func(index int) {
+				defer wg.Done()
+				healthErrs[index] = checkHealthWithin(backends[index], time.Duration(configs[index].Timeout)*time.Second)
+			}(index)
+		}
+		wg.Wait()
+
+		// only one backend has to be up, the others may be offline for now,
+		// but a rejected password or an invalid pool is a mistake in the data
+		var healthy []int
+		var firstErr error
+		for index, err := range healthErrs {
+			pool := index == 0 && params.Kind == "pool"
+			switch {
+			case err == nil:
+				if !pool {
+					healthy = append(healthy, index)
+				}
+				continue
+			case errors.Is(err, errWrongPassword):
+				if index == 0 {
+					return "", "", nil, errors.New("wrong password: the backend rejected it")
+				}
+				return "", "", nil, fmt.Errorf("wrong password for backend %d: the backend rejected it", index)
+			case pool:
+				return "", "", nil, err
+			}
+
+			log.Warn().Err(err).Str("name", name).Str("domain", domain).Int("backend_index", index).
+				Msg("backend failed its health check")
+			warnings = append(warnings, fmt.Sprintf("backend %d couldn't be reached: %s", index, err))
+			if firstErr == nil {
+				if index == 0 {
+					firstErr = fmt.Errorf("couldn't reach the backend with the given data: %w", err)
+				} else {
+					firstErr = fmt.Errorf("couldn't reach backend %d with the given data: %w", index, err)
+				}
+			}
+		}
+		if len(healthy) == 0 {
+			return "", "", nil, firstErr
 		}
 
+		if inv, err = makeTestInvoice(params, pin, healthy); err != nil {
+			return "", "", nil, fmt.Errorf("couldn't make an invoice with the given data: %w", err)
+		}
+
+	} else {
+		// forward accounts can't make a test invoice, but their target must resolve
+		forward := ForwardParams{Host: params.Host}
+		if err := CheckHealth(forward); err != nil {
+			return "", "", nil, fmt.Errorf("couldn't resolve the forward target: %w", err)
+		}
 	}
 
 	// save it
 	data, _ := jsoniter.Marshal(params)
 	if err := db.Set(key, data, pebble.Sync); err != nil {
-		return "", "", err
+		return "", "", nil, err
 	}
 
-	return pin, inv, nil
+	return pin, inv, warnings, nil
 }
 
 func GetName(name, domain string) (*Params, error) {
@@ -33,75 +33,71 @@ func metaData(params *Params) lnurl.Metadata {
 
 }
 
-func makeInvoice(params *Params, msat int, pin *string, zapEventSerializedStr string, comment string) (bolt11 string, err error) {
+// makeInvoice tries the backends of an address in the order given by its
+// routing rules until one of them issues the invoice, and returns which one
+// did and the id it gave the invoice, if any.
+func makeInvoice(params *Params, msat int, zapEventSerializedStr string, comment string) (bolt11 string, backendIndex int, ref string, err error) {
 	// prepare params
 
-	var backend BackendParams
-	switch params.Kind {
-	case "sparko":
-		backend = SparkoParams{
-			Host: params.Host,
-			Key:  params.Key,
-		}
-	case "lnd":
-		backend = LNDParams{
-			Host:     params.Host,
-			Macaroon: params.Key,
-		}
-	case "lnbits":
-		backend = LNBitsParams{
-			Host: params.Host,
-			Key:  params.Key,
-		}
-	case "lnpay":
-		backend = LNPayParams{
-			PublicAccessKey:  params.Pak,
-			WalletInvoiceKey: params.Waki,
-		}
-	case "eclair":
-		backend = EclairParams{
-			Host:     params.Host,
-			Password: "",
-		}
-	case "commando":
-		backend = CommandoParams{
-			Host:   params.Host,
-			NodeId: params.NodeId,
-			Rune:   params.Rune,
-		}
-	}
-
 	mip := LNParams{
 		Msatoshi: int64(msat),
-		Backend:  backend,
 
 		Label: params.Domain + "/" + strconv.FormatInt(time.Now().Unix(), 16),
 	}
 
-	if pin != nil {
-		// use this as the description for new accounts
-		mip.UseDescriptionHash = false
-		mip.Description = fmt.Sprintf("%s's PIN for '%s@%s' lightning address: %s", params.Domain, params.Name, params.Domain, *pin)
-	} else {
-		//use zapEventSerializedStr if nip57,
-		mip.UseDescriptionHash = true
-		if zapEventSerializedStr != "" {
-			mip.Description = zapEventSerializedStr
-
-		} else {
-			//else build hash descriptionhash from params
-			mip.Description = metaData(params).Encode()
-		}
+	//use zapEventSerializedStr if nip57,
+	mip.UseDescriptionHash = true
+	if zapEventSerializedStr != "" {
+		mip.Description = zapEventSerializedStr
 
+	} else {
+		//else build hash descriptionhash from params
+		mip.Description = metaData(params).Encode()
 	}
 
-	// actually generate the invoice
-	bolt11, err = MakeInvoice(mip)
+	order := params.backendOrder(int64(msat), zapEventSerializedStr != "", comment != "")
+	return issueInvoice(params, order, mip)
+}
 
-	log.Debug().Int("msatoshi", msat).
-		Interface("backend", backend).
-		Str("bolt11", bolt11).Err(err).Str("Description", mip.Description).
-		Msg("invoice generation")
+// makeTestInvoice makes the invoice showing the PIN of a new address on the
+// first of the given backends that issues it. It isn't a payment, so routing
+// rules don't apply to it.
+func makeTestInvoice(params *Params, pin string, order []int) (bolt11 string, err error) {
+	mip := LNParams{
+		Msatoshi:    1000,
+		Label:       params.Domain + "/" + strconv.FormatInt(time.Now().Unix(), 16),
+		Description: fmt.Sprintf("%s's PIN for '%s@%s' lightning address: %s", params.Domain, params.Name, params.Domain, pin),
+	}
 
+	bolt11, _, _, err = issueInvoice(params, order, mip)
 	return bolt11, err
 }
+
+// issueInvoice asks the backends with the given indexes in backendConfigs for
+// the invoice, one after the other, until one of them issues it.
+func issueInvoice(params *Params, order []int, mip LNParams) (bolt11 string, backendIndex int, ref string, err error) {
+	configs := params.backendConfigs()
+	for _, index := range order {
+		config := configs[index]
+		backend, berr := backendFromParams(config)
+		if berr != nil {
+			err = berr
+			continue
+		}
+		mip.Backend = backend
+
+		// actually generate the invoice
+		bolt11, ref, err = makeInvoiceWithin(mip, time.Duration(config.Timeout)*time.Second)
+
+		log.Debug().Int("msatoshi", int(mip.Msatoshi)).Int("backend_index", index).
+			Str("kind", config.Kind).Str("backend_id", backendID(backend)).
+			Str("bolt11", bolt11).Err(err).Str("Description", mip.Description).
+			Msg("invoice generation")
+
+		if err == nil {
+			return bolt11, index, ref, nil
+		}
+	}
+
+	return "", 0, "", err
+}
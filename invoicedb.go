@@ -0,0 +1,49 @@
+package main
+
+import (
+	"github.com/cockroachdb/pebble"
+	jsoniter "github.com/json-iterator/go"
+)
+
+// invoicesDb holds the invoices we are still waiting on, so zap receipts and
+// notifications survive a restart. It is kept apart from the users db because
+// everything in there is read back as Params.
+var invoicesDb *pebble.DB
+
+type StoredInvoice struct {
+	PaymentHash string               `json:"payment_hash"`
+	Name        string               `json:"name"`
+	Domain      string               `json:"domain"`
+	ExpiresAt   int64                `json:"expires_at"`
+	PayValues   LNURLPayValuesCustom `json:"payvalues"`
+}
+
+func SavePendingInvoice(invoice StoredInvoice) error {
+	data, err := jsoniter.Marshal(invoice)
+	if err != nil {
+		return err
+	}
+	return invoicesDb.Set([]byte(invoice.PaymentHash), data, pebble.Sync)
+}
+
+func DeletePendingInvoice(paymentHash string) error {
+	return invoicesDb.Delete([]byte(paymentHash), pebble.Sync)
+}
+
+func GetPendingInvoices() ([]StoredInvoice, error) {
+	var invoices []StoredInvoice
+
+	iter := invoicesDb.NewIter(nil)
+	defer iter.Close()
+
+	for iter.First(); iter.Valid(); iter.Next() {
+		var invoice StoredInvoice
+		if err := jsoniter.Unmarshal(iter.Value(), &invoice); err != nil {
+			log.Debug().Err(err).Str("payment_hash", string(iter.Key())).Msg("Unmarshal error")
+			continue
+		}
+		invoices = append(invoices, invoice)
+	}
+
+	return invoices, iter.Error()
+}
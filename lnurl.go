@@ -14,9 +14,6 @@ import (
 	decodepay "github.com/nbd-wtf/ln-decodepay"
 )
 
-var allowNostr bool = false
-var nostrPrivkeyHex string = ""
-var nostrPubkey string = ""
 var minSendable int = 1000
 var maxSendable int = 1000000000
 var CommentAllowed int = 500
@@ -45,12 +42,16 @@ type LNURLPayValuesCustom struct {
 	CreatedAt          time.Time            `json:"created_at"`
 	Paid               bool                 `json:"paid"`
 	PaidAt             time.Time            `json:"paid_at"`
+	MSatoshiReceived   int64                `json:"msatoshi_received"`
 	From               string               `json:"from"`
 	ParsedInvoice      decodepay.Bolt11     `json:"-"`
 	PayerDataJSON      string               `json:"-"`
 	Nip57Receipt       nostr.Event          `json:"nip57Receipt"`
 	Nip57ReceiptRelays []string             `json:"nip57ReceiptRelays"`
 	AwaitInvoicePaid   bool                 `json:"awaitInvoicePaid"`
+	Backend            int                  `json:"backend"`              // index of the backend that issued PR
+	BackendID          string               `json:"backendId,omitempty"`  // see backendID, the index alone may point elsewhere after an edit
+	BackendRef         string               `json:"backendRef,omitempty"` // that backend's id for PR, see InvoiceReferrer
 	Sender             string               `json:"sender"`
 	Note               string               `json:"note"`
 }
@@ -91,10 +92,10 @@ func handleLNURL(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	//if account is a forward account we simply redirect to the other address.
-	//everything is handled from there. In this case, we only provide Address/NIP05
+	//if account is a forward account we proxy the other address, so wallets only
+	//ever talk to us. Our own Address/NIP05 stay in place
 	if params.Kind == "forward" {
-		http.Redirect(w, r, params.Host, http.StatusSeeOther)
+		serveForward(w, r, params, username, domain)
 		return
 	}
 
@@ -112,18 +113,29 @@ func handleLNURL(w http.ResponseWriter, r *http.Request) {
 			maxSendable = 1000000000
 		}
 
-		// if a nostr private nsec key is set, set nostr nip57 flags
-		if len(s.NostrPrivateKey) > 0 {
-			//allows users to use nsec keys, work with hex internally.
-			//This can be any private key, not necessarily from the user.
-			nostrPrivkeyHex = DecodeBench32(s.NostrPrivateKey)
-			allowNostr = true
-			pk := nostrPrivkeyHex
-			pub, _ := nostr.GetPublicKey(pk)
-			nostrPubkey = pub
+		// only offer amounts the backends can invoice exactly
+		capabilities := params.capabilities()
+		step := capabilities.amountStep()
+		minSendable = (minSendable + step - 1) / step * step
+		maxSendable = maxSendable / step * step
+
+		// nothing in the configured range can be invoiced exactly
+		if minSendable > maxSendable {
+			json.NewEncoder(w).Encode(lnurl.ErrorResponse(fmt.Sprintf(
+				"%s@%s can't receive any amount between its minSendable and maxSendable", username, domain)))
+			return
+		}
+
+		// zaps need a receipt, which we can only publish if we see the payment
+		// and the invoice commits to the zap request
+		allowsNostr := nostrPubkey != "" && capabilities.InvoiceLookup && capabilities.DescriptionHash
+		zapPubkey := ""
+		if allowsNostr {
+			zapPubkey = nostrPubkey
 		}
 
 		//serveLNURLpFirst
+		//nostr nip57 flags are only set if a nostr private nsec key is set
 		json.NewEncoder(w).Encode(LNURLPayParamsCustom{
 			LNURLResponse:   lnurl.LNURLResponse{Status: "OK"},
 			Callback:        fmt.Sprintf("https://%s/.well-known/lnurlp/%s", domain, username),
@@ -132,8 +144,8 @@ func handleLNURL(w http.ResponseWriter, r *http.Request) {
 			EncodedMetadata: metaData(params).Encode(),
 			CommentAllowed:  int64(CommentAllowed),
 			Tag:             "payRequest",
-			AllowsNostr:     allowNostr,
-			NostrPubKey:     nostrPubkey,
+			AllowsNostr:     allowsNostr,
+			NostrPubKey:     zapPubkey,
 		})
 
 	} else {
@@ -217,7 +229,7 @@ func handleLNURL(w http.ResponseWriter, r *http.Request) {
 		//in order to submit the zap on nostr
 		//also check for invoice paid for regular ln payments for nostr notificaitons
 		if payvaluescustom.AwaitInvoicePaid {
-			go WaitForInvoicePaid(payvaluescustom, params)
+			WaitForInvoicePaid(payvaluescustom, params)
 		}
 	}
 }
@@ -232,15 +244,24 @@ func serveLNURLpSecond(w http.ResponseWriter, params *Params, username string, a
 				Reason: fmt.Sprintf("Amount out of bounds (min: %d sat, max: %d sat).", minSendable/1000, maxSendable/1000)},
 		}, fmt.Errorf("amount out of bounds")
 	}
+	if step := params.capabilities().amountStep(); int64(amount_msat)%step != 0 {
+		return LNURLPayValuesCustom{
+			LNURLResponse: lnurl.LNURLResponse{
+				Status: "Error",
+				Reason: fmt.Sprintf("Amount must be a multiple of %d msat.", step)},
+		}, fmt.Errorf("amount not a multiple of %d msat", step)
+	}
 
 	// NIP57 ZAPs
 	// for nip57 use the nostr event as the descriptionHash
+	// everything zap related is local to this request, concurrent zaps must not share any of it
+	var zapEventSerializedStr string
+	var nip57ReceiptRelays []string
 	if zapEvent.Sig != "" {
 
 		// we calculate the descriptionHash here, create an invoice with it
 		// and store the invoice in the zap receipt later down the line
 		zapEventSerialized, err := json.Marshal(zapEvent)
-		zapEventSerializedStr = fmt.Sprintf("%s", zapEventSerialized)
 		if err != nil {
 			return LNURLPayValuesCustom{
 				LNURLResponse: lnurl.LNURLResponse{
@@ -248,17 +269,17 @@ func serveLNURLpSecond(w http.ResponseWriter, params *Params, username string, a
 					Reason: "Couldn't serialize zap event."},
 			}, err
 		}
+		zapEventSerializedStr = string(zapEventSerialized)
 		// we extract the relays from the zap request
 		nip57ReceiptRelays = ExtractNostrRelays(zapEvent)
 
 	} else {
 		//If we have a regular call, we ignore zapEvent in makeinvoice later.
-		zapEventSerializedStr = ""
 		log.Debug().Str("Regular Invoice", "Not an NIP57 event").Msg("Note")
 	}
 
 	var response LNURLPayValuesCustom
-	invoice, err := makeInvoice(params, amount_msat, nil, zapEventSerializedStr, comment)
+	invoice, backendIndex, backendRef, err := makeInvoice(params, amount_msat, zapEventSerializedStr, comment)
 	if err != nil {
 		err = fmt.Errorf("couldn't create invoice: %v", err.Error())
 		response = LNURLPayValuesCustom{
@@ -273,10 +294,13 @@ func serveLNURLpSecond(w http.ResponseWriter, params *Params, username string, a
 	var awaitPaid = true
 	var sender = ""
 	var note = ""
+	var nip57Receipt nostr.Event
 	// nip57 - we need to store the newly created invoice in the zap receipt
 	if zapEvent.Sig != "" {
-		// TODO: Handle the err
 		nip57Receipt, err = CreateNostrReceipt(zapEvent, invoice)
+		if err != nil {
+			log.Error().Err(err).Msg("couldn't create zap receipt")
+		}
 		sender = "@" + EncodeBench32Public(zapEvent.PubKey)
 		if zapEvent.Tags.GetFirst([]string{"e"}) != nil {
 			note = "@" + EncodeBench32Note(zapEvent.Tags.GetFirst([]string{"e"}).Value())
@@ -289,6 +313,11 @@ func serveLNURLpSecond(w http.ResponseWriter, params *Params, username string, a
 		log.Debug().Str("Zap from", sender).Msg("Nostr")
 	}
 
+	var issuerID string
+	if issuer, err := backendAt(params, backendIndex); err == nil {
+		issuerID = backendID(issuer)
+	}
+
 	decoded_invoice, _ := decodepay.Decodepay(invoice)
 	return LNURLPayValuesCustom{
 		LNURLResponse:      lnurl.LNURLResponse{Status: "OK"},
@@ -302,8 +331,57 @@ func serveLNURLpSecond(w http.ResponseWriter, params *Params, username string, a
 		Nip57Receipt:       nip57Receipt,
 		Nip57ReceiptRelays: nip57ReceiptRelays,
 		AwaitInvoicePaid:   awaitPaid,
+		Backend:            backendIndex,
+		BackendID:          issuerID,
+		BackendRef:         backendRef,
 		Sender:             sender,
 		Note:               note,
 	}, nil
 
 }
+
+// serveForward resolves the forward target of an account and serves its
+// LNURL-pay flow under our address.
+func serveForward(w http.ResponseWriter, r *http.Request, params *Params, username, domain string) {
+	forward := ForwardParams{Host: params.Host}
+
+	payParams, err := forward.payParams()
+	if err != nil {
+		log.Error().Err(err).Str("name", username).Str("domain", domain).Msg("failed to resolve forward target")
+		json.NewEncoder(w).Encode(lnurl.ErrorResponse("Couldn't reach the forwarded address."))
+		return
+	}
+
+	amount := r.URL.Query().Get("amount")
+	if amount == "" {
+		// the target's metadata is served as is, since its invoices commit to it
+		payParams.LNURLResponse = lnurl.LNURLResponse{Status: "OK"}
+		payParams.Callback = fmt.Sprintf("https://%s/.well-known/lnurlp/%s", domain, username)
+		json.NewEncoder(w).Encode(payParams)
+		return
+	}
+
+	msat, err := strconv.ParseInt(amount, 10, 64)
+	if err != nil {
+		json.NewEncoder(w).Encode(lnurl.ErrorResponse("amount is not integer"))
+		return
+	}
+	if msat < payParams.MinSendable || msat > payParams.MaxSendable {
+		json.NewEncoder(w).Encode(lnurl.ErrorResponse(fmt.Sprintf(
+			"Amount out of bounds (min: %d sat, max: %d sat).", payParams.MinSendable/1000, payParams.MaxSendable/1000)))
+		return
+	}
+
+	values, err := forward.fetchInvoice(payParams, msat, r.URL.Query())
+	if err != nil {
+		log.Error().Err(err).Str("name", username).Str("domain", domain).Msg("failed to get invoice from forward target")
+		json.NewEncoder(w).Encode(lnurl.ErrorResponse("Couldn't create invoice."))
+		return
+	}
+
+	values.LNURLResponse = lnurl.LNURLResponse{Status: "OK"}
+	if values.Routes == nil {
+		values.Routes = make([]struct{}, 0)
+	}
+	json.NewEncoder(w).Encode(values)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/gorilla/mux"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/nbd-wtf/go-nostr"
+	decodepay "github.com/nbd-wtf/ln-decodepay"
+)
+
+type publishedEvent struct {
+	event  nostr.Event
+	relays []string
+}
+
+// setupTestServer points the globals at fresh databases and a fake backend
+// account "alice", and serves the lnurlp endpoint.
+func setupTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	oldSettings := s
+	s = Settings{Domain: "example.com", Secret: "secret", FakeBackend: true}
+	t.Cleanup(func() { s = oldSettings })
+
+	for _, one := range []**pebble.DB{&db, &invoicesDb, &cashuDb} {
+		opened, err := pebble.Open(t.TempDir(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		*one = opened
+		t.Cleanup(func() { opened.Close() })
+	}
+
+	setupNostrKeys(nostr.GeneratePrivateKey())
+	t.Cleanup(func() { nostrPrivkeyHex, nostrPubkey = "", "" })
+
+	watcher = startInvoiceWatcher(4)
+
+	data, _ := jsoniter.Marshal(Params{Kind: "fake"})
+	if err := db.Set([]byte(getID("alice", "example.com")), data, pebble.Sync); err != nil {
+		t.Fatal(err)
+	}
+
+	router := mux.NewRouter()
+	router.Path("/.well-known/lnurlp/{user}").Methods("GET").HandlerFunc(handleLNURL)
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestConcurrentZapsGetTheirOwnReceipts(t *testing.T) {
+	server := setupTestServer(t)
+
+	const zaps = 20
+	published := make(chan publishedEvent, zaps)
+	oldPublish := publishNostrEvent
+	publishNostrEvent = func(ev nostr.Event, relays []string) {
+		published <- publishedEvent{ev, relays}
+	}
+	t.Cleanup(func() { publishNostrEvent = oldPublish })
+
+	receiver := nostr.GeneratePrivateKey()
+	receiverPub, _ := nostr.GetPublicKey(receiver)
+
+	// every zap request has its own sender, relays and comment
+	requests := make(map[string]nostr.Event) // by bolt11
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < zaps; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			zapRequest := nostr.Event{
+				CreatedAt: time.Now(),
+				Kind:      9734,
+				Content:   fmt.Sprintf("zap %d", i),
+				Tags: nostr.Tags{
+					{"p", receiverPub},
+					{"relays", fmt.Sprintf("wss://relay%d.example.com", i), "wss://shared.example.com"},
+				},
+			}
+			if err := zapRequest.Sign(nostr.GeneratePrivateKey()); err != nil {
+				t.Error(err)
+				return
+			}
+			encoded, _ := json.Marshal(zapRequest)
+
+			query := url.Values{}
+			query.Set("amount", fmt.Sprintf("%d", (i+1)*1000))
+			query.Set("nostr", string(encoded))
+			resp, err := http.Get(server.URL + "/.well-known/lnurlp/alice?" + query.Encode())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer resp.Body.Close()
+
+			var values struct {
+				Status string `json:"status"`
+				Reason string `json:"reason"`
+				PR     string `json:"pr"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&values); err != nil {
+				t.Error(err)
+				return
+			}
+			if values.PR == "" {
+				t.Errorf("zap %d got no invoice: %s %s", i, values.Status, values.Reason)
+				return
+			}
+
+			mu.Lock()
+			requests[values.PR] = zapRequest
+			mu.Unlock()
+		}(i)
+	}
+	wg.Wait()
+	if t.Failed() {
+		return
+	}
+
+	for bolt11 := range requests {
+		decoded, err := decodepay.Decodepay(bolt11)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fakeInvoicesMu.Lock()
+		fakeInvoices[decoded.PaymentHash].paidAt = time.Now()
+		fakeInvoicesMu.Unlock()
+	}
+
+	timeout := time.After(4 * invoicePollInterval)
+	for received := 0; received < zaps; received++ {
+		var one publishedEvent
+		select {
+		case one = <-published:
+		case <-timeout:
+			t.Fatalf("only %d of %d receipts were published", received, zaps)
+		}
+
+		receipt := one.event
+		bolt11 := receipt.Tags.GetFirst([]string{"bolt11"})
+		if bolt11 == nil {
+			t.Fatal("receipt without bolt11 tag")
+		}
+		zapRequest, ok := requests[bolt11.Value()]
+		if !ok {
+			t.Fatalf("receipt for unknown invoice %s", bolt11.Value())
+		}
+		delete(requests, bolt11.Value())
+
+		var described nostr.Event
+		if err := json.Unmarshal([]byte(receipt.Tags.GetFirst([]string{"description"}).Value()), &described); err != nil {
+			t.Fatal(err)
+		}
+		if described.ID != zapRequest.ID || described.Content != zapRequest.Content {
+			t.Errorf("receipt for %q describes zap request %q", zapRequest.Content, described.Content)
+		}
+		if !reflect.DeepEqual(one.relays, ExtractNostrRelays(zapRequest)) {
+			t.Errorf("receipt for %q published to %v", zapRequest.Content, one.relays)
+		}
+		if p := receipt.Tags.GetFirst([]string{"p"}); p == nil || p.Value() != receiverPub {
+			t.Errorf("receipt for %q has the wrong p tag", zapRequest.Content)
+		}
+		if ok, _ := receipt.CheckSignature(); !ok || receipt.PubKey != nostrPubkey {
+			t.Errorf("receipt for %q isn't signed by the server", zapRequest.Content)
+		}
+	}
+}
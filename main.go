@@ -12,7 +12,6 @@ import (
 	"time"
 
 	"github.com/cockroachdb/pebble"
-	"github.com/fiatjaf/makeinvoice"
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
 	"github.com/kelseyhightower/envconfig"
@@ -44,6 +43,8 @@ type Settings struct {
 	AllowRegistration  bool   `envconfig:"ALLOW_REGISTRATION" required:"false" default:"true"`
 	AllowAPI           bool   `envconfig:"ALLOW_API" required:"false" default:"true"`
 	LNDprivateOnly     bool   `envconfig:"LND_PRIVATE_ONLY" required:"false" default:"false"`
+	InvoiceWatchers    int    `envconfig:"INVOICE_WATCHERS" required:"false" default:"8"`
+	FakeBackend        bool   `envconfig:"FAKE_BACKEND" required:"false" default:"false"`
 }
 
 var (
@@ -86,13 +87,15 @@ func main() {
 		}
 	}
 
-	// increase default makeinvoice client timeout because people are using tor
-	makeinvoice.Client = &http.Client{Timeout: 25 * time.Second}
+	setupNostrKeys(s.NostrPrivateKey)
+
+	// increase default backend client timeout because people are using tor
+	ClientTimeout = 25 * time.Second
 
 	s.Domain = strings.ToLower(s.Domain)
 
 	if s.TorProxyURL != "" {
-		makeinvoice.TorProxyURL = s.TorProxyURL
+		TorProxyURL = s.TorProxyURL
 	}
 
 	dbName := path.Join(s.DBDirectory, fmt.Sprintf("%v-multiple.db", s.SiteName))
@@ -107,6 +110,21 @@ func main() {
 		log.Fatal().Err(err).Str("path", dbName).Msg("failed to open db.")
 	}
 
+	invoicesDbName := path.Join(s.DBDirectory, fmt.Sprintf("%v-invoices.db", s.SiteName))
+	invoicesDb, err = pebble.Open(invoicesDbName, nil)
+	if err != nil {
+		log.Fatal().Err(err).Str("path", invoicesDbName).Msg("failed to open db.")
+	}
+
+	cashuDbName := path.Join(s.DBDirectory, fmt.Sprintf("%v-cashu.db", s.SiteName))
+	cashuDb, err = pebble.Open(cashuDbName, nil)
+	if err != nil {
+		log.Fatal().Err(err).Str("path", cashuDbName).Msg("failed to open db.")
+	}
+
+	watcher = startInvoiceWatcher(s.InvoiceWatchers)
+	watcher.Resume()
+
 	router.Path("/.well-known/lnurlp/{user}").Methods("GET").
 		HandlerFunc(handleLNURL)
 
@@ -134,6 +152,10 @@ func main() {
 		},
 	)
 
+	if s.FakeBackend {
+		router.Path("/debug/fake/pay/{hash}").Methods("POST").HandlerFunc(PayFakeInvoice)
+	}
+
 	router.PathPrefix("/static/").Handler(http.FileServer(http.FS(static)))
 
 	router.Path("/grab").HandlerFunc(
@@ -171,7 +193,7 @@ func main() {
 			if v3 == "on" {
 				notifyNonZaps = true
 			}
-			pin, inv, err := SaveName(name, domain, &Params{
+			pin, inv, warnings, err := SaveName(name, domain, &Params{
 				Kind:             r.FormValue("kind"),
 				Host:             r.FormValue("host"),
 				Key:              r.FormValue("key"),
@@ -179,6 +201,16 @@ func main() {
 				Waki:             r.FormValue("waki"),
 				NodeId:           r.FormValue("nodeid"),
 				Rune:             r.FormValue("rune"),
+				Username:         r.FormValue("username"),
+				Currency:         r.FormValue("currency"),
+				NWC:              r.FormValue("nwc"),
+				Login:            r.FormValue("login"),
+				Password:         r.FormValue("password"),
+				StoreId:          r.FormValue("storeid"),
+				CustomInvoice:    customRequestFromForm(r, "custom_invoice"),
+				CustomStatus:     customRequestFromForm(r, "custom_status"),
+				Mint:             r.FormValue("mint"),
+				Cert:             r.FormValue("cert"),
 				Npub:             r.FormValue("npub"),
 				NotifyZaps:       notifyZaps,
 				NotifyZapComment: notifyComments,
@@ -191,11 +223,12 @@ func main() {
 			}
 
 			renderHTML(w, grabHTML, struct {
-				PIN          string `json:"pin"`
-				Invoice      string `json:"invoice"`
-				Name         string `json:"name"`
-				ActualDomain string `json:"actual_domain"`
-			}{pin, inv, name, domain})
+				PIN          string   `json:"pin"`
+				Invoice      string   `json:"invoice"`
+				Warnings     []string `json:"warnings"`
+				Name         string   `json:"name"`
+				ActualDomain string   `json:"actual_domain"`
+			}{pin, inv, warnings, name, domain})
 		},
 	)
 
@@ -223,17 +256,27 @@ func main() {
 				currentPin := r.FormValue("pin")
 
 				params := Params{
-					Kind:   r.FormValue("kind"),
-					Host:   r.FormValue("host"),
-					Key:    r.FormValue("key"),
-					Pak:    r.FormValue("pak"),
-					Waki:   r.FormValue("waki"),
-					NodeId: r.FormValue("nodeid"),
-					Rune:   r.FormValue("rune"),
-					Npub:   r.FormValue("npub"),
+					Kind:          r.FormValue("kind"),
+					Host:          r.FormValue("host"),
+					Key:           r.FormValue("key"),
+					Pak:           r.FormValue("pak"),
+					Waki:          r.FormValue("waki"),
+					NodeId:        r.FormValue("nodeid"),
+					Rune:          r.FormValue("rune"),
+					Username:      r.FormValue("username"),
+					Currency:      r.FormValue("currency"),
+					NWC:           r.FormValue("nwc"),
+					Login:         r.FormValue("login"),
+					Password:      r.FormValue("password"),
+					StoreId:       r.FormValue("storeid"),
+					CustomInvoice: customRequestFromForm(r, "custom_invoice"),
+					CustomStatus:  customRequestFromForm(r, "custom_status"),
+					Mint:          r.FormValue("mint"),
+					Cert:          r.FormValue("cert"),
+					Npub:          r.FormValue("npub"),
 				}
 
-				pin, _, err := SaveName(newname, domain, &params, currentPin, true, currentName)
+				pin, _, warnings, err := SaveName(newname, domain, &params, currentPin, true, currentName)
 				if err != nil {
 					w.WriteHeader(500)
 					fmt.Fprint(w, err.Error())
@@ -242,8 +285,9 @@ func main() {
 				params.Pin = pin
 
 				response := ResponseEasy{
-					Ok:  true,
-					Pin: pin,
+					Ok:       true,
+					Pin:      pin,
+					Warnings: warnings,
 				}
 
 				w.Header().Set("Content-Type", "application/json")
@@ -264,6 +308,8 @@ func main() {
 		api.HandleFunc("/users/{name}@{domain}", GetUser).Methods("GET")
 		api.HandleFunc("/users/{name}@{domain}", UpdateUser).Methods("PUT")
 		api.HandleFunc("/users/{name}@{domain}", DeleteUser).Methods("DELETE")
+		api.HandleFunc("/users/{name}@{domain}/cashu", GetCashuBalance).Methods("GET")
+		api.HandleFunc("/users/{name}@{domain}/cashu/redeem", RedeemCashu).Methods("POST")
 
 		srv := &http.Server{
 			Handler:      cors.Default().Handler(router),
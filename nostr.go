@@ -36,9 +36,27 @@ type NostrEvent struct {
 	Sig       string    `json:"sig"`
 }
 
-var nip57Receipt nostr.Event
-var zapEventSerializedStr string
-var nip57ReceiptRelays []string
+// the server's nostr keys, derived once from NOSTR_PRIVATE_KEY at startup.
+// they are only read afterwards, all zap state lives in the request.
+var nostrPrivkeyHex string = ""
+var nostrPubkey string = ""
+
+func setupNostrKeys(privateKey string) {
+	if len(privateKey) == 0 {
+		return
+	}
+
+	//allows users to use nsec keys, work with hex internally.
+	//This can be any private key, not necessarily from the user.
+	nostrPrivkeyHex = DecodeBench32(privateKey)
+	pub, err := nostr.GetPublicKey(nostrPrivkeyHex)
+	if err != nil {
+		log.Error().Err(err).Msg("invalid nostr private key, zaps are disabled")
+		nostrPrivkeyHex = ""
+		return
+	}
+	nostrPubkey = pub
+}
 
 func Nip57DescriptionHash(zapEventSerialized string) string {
 	hash := sha256.Sum256([]byte(zapEventSerialized))
@@ -155,7 +173,8 @@ func handleNip05(w http.ResponseWriter, r *http.Request) {
 }
 
 func GetNostrProfileMetaData(npub string, index int) (nostr.ProfileMetadata, error) {
-	ctx, _ := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
 
 	var metadata *nostr.ProfileMetadata
 	// connect to first relay, todo, check on all/for errors
@@ -289,7 +308,9 @@ func DownloadProfilePicture(url string) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-func publishNostrEvent(ev nostr.Event, relays []string) {
+// publishNostrEvent signs ev and sends it to the given relays and our own.
+// A variable so tests can catch receipts instead of talking to relays.
+var publishNostrEvent = func(ev nostr.Event, relays []string) {
 	// Add more relays, remove trailing slashes, and ensure unique relays
 	relays = uniqueSlice(cleanUrls(append(relays, Relays...)))
 
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+)
+
+// RoutingRule sends the invoices it matches to one of the backends of an
+// address. Unset conditions match everything.
+type RoutingRule struct {
+	MinSendable int64 `json:"minSendable,omitempty"` // msat, inclusive
+	MaxSendable int64 `json:"maxSendable,omitempty"` // msat, inclusive, 0 means no limit
+	Zap         *bool `json:"zap,omitempty"`         // only zaps or only regular payments
+	Comment     *bool `json:"comment,omitempty"`     // only payments with or without a comment
+
+	// index into the backends of the address, 0 being its own fields
+	Backend int `json:"backend"`
+}
+
+func (rule RoutingRule) matches(msat int64, zap bool, comment bool) bool {
+	if msat < rule.MinSendable {
+		return false
+	}
+	if rule.MaxSendable != 0 && msat > rule.MaxSendable {
+		return false
+	}
+	if rule.Zap != nil && *rule.Zap != zap {
+		return false
+	}
+	if rule.Comment != nil && *rule.Comment != comment {
+		return false
+	}
+	return true
+}
+
+// backendOrder returns the indexes of the backends of an address in the order
+// they should be tried for an invoice. The backend of the first matching rule
+// comes first, or the next member for pools, the others follow in their usual
+// order for failover.
+func (params *Params) backendOrder(msat int64, zap bool, comment bool) []int {
+	count := len(params.backendConfigs())
+
+	pool := params.Kind == "pool" && len(params.Backends) > 0
+
+	first := -1
+	for _, rule := range params.Rules {
+		if rule.Backend >= 0 && rule.Backend < count && rule.matches(msat, zap, comment) {
+			first = rule.Backend
+			break
+		}
+	}
+	if first == -1 {
+		first = 0
+		if pool {
+			first = params.nextPoolMember()
+		}
+	}
+
+	order := []int{first}
+	for index := 0; index < count; index++ {
+		// the pool itself can't issue invoices, only its members
+		if index != first && !(pool && index == 0) {
+			order = append(order, index)
+		}
+	}
+	return order
+}
+
+func (params *Params) validateRules() error {
+	count := len(params.backendConfigs())
+	for i, rule := range params.Rules {
+		if rule.Backend < 0 || rule.Backend >= count {
+			return fmt.Errorf("routing rule %d points to backend %d, but there are only %d", i, rule.Backend, count)
+		}
+		if params.Kind == "pool" && rule.Backend == 0 {
+			return fmt.Errorf("routing rule %d points to the pool itself, which can't issue invoices", i)
+		}
+		if rule.MaxSendable != 0 && rule.MaxSendable < rule.MinSendable {
+			return fmt.Errorf("routing rule %d has a maxSendable below its minSendable", i)
+		}
+	}
+	return nil
+}
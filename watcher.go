@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	decodepay "github.com/nbd-wtf/ln-decodepay"
+)
+
+const (
+	invoicePollInterval = 3 * time.Second
+	maxSubscriptions    = 200
+)
+
+// watcher owns every invoice we are waiting on to publish zap receipts and
+// send notifications. It is started in main.
+var watcher *invoiceWatcher
+
+type pendingInvoice struct {
+	payvalues LNURLPayValuesCustom
+	params    *Params
+	backend   BackendParams
+	bolt11    decodepay.Bolt11
+	expiresAt time.Time
+
+	// set while a push subscription is following this invoice, so it isn't polled
+	subscribed bool
+}
+
+type invoiceBatch struct {
+	key      string
+	invoices []*pendingInvoice
+}
+
+// invoiceWatcher follows invoices until they are paid or their bolt11 expires.
+// Backends that can push settlement events get a subscription per invoice, as
+// long as there are free slots. Everything else is polled in one batch per
+// backend, by a fixed number of workers, so a single node is never queried
+// for the same invoices in parallel.
+type invoiceWatcher struct {
+	mu       sync.Mutex
+	pending  map[string]*pendingInvoice // by payment hash
+	inFlight map[string]bool            // backend keys with a batch being polled
+
+	batches       chan invoiceBatch
+	subscriptions chan struct{}
+}
+
+func startInvoiceWatcher(workers int) *invoiceWatcher {
+	if workers < 1 {
+		workers = 1
+	}
+
+	w := &invoiceWatcher{
+		pending:       make(map[string]*pendingInvoice),
+		inFlight:      make(map[string]bool),
+		batches:       make(chan invoiceBatch),
+		subscriptions: make(chan struct{}, maxSubscriptions),
+	}
+
+	for i := 0; i < workers; i++ {
+		go w.work()
+	}
+	go w.schedule()
+
+	return w
+}
+
+func (w *invoiceWatcher) Watch(payvalues LNURLPayValuesCustom, params *Params) {
+	inv, err := newPendingInvoice(payvalues, params)
+	if err != nil {
+		log.Debug().Err(err).Str("kind", params.Kind).Msg("not waiting for payment")
+		return
+	}
+
+	if err := SavePendingInvoice(StoredInvoice{
+		PaymentHash: inv.bolt11.PaymentHash,
+		Name:        params.Name,
+		Domain:      params.Domain,
+		ExpiresAt:   inv.expiresAt.Unix(),
+		PayValues:   payvalues,
+	}); err != nil {
+		log.Error().Err(err).Str("payment_hash", inv.bolt11.PaymentHash).Msg("failed to store pending invoice")
+	}
+
+	w.add(inv)
+}
+
+// Resume picks up the invoices that were still pending when the server stopped.
+// Unexpired ones are watched again, expired ones are checked once in case
+// they were paid while we were down.
+func (w *invoiceWatcher) Resume() {
+	stored, err := GetPendingInvoices()
+	if err != nil {
+		log.Error().Err(err).Msg("failed to load pending invoices")
+	}
+
+	for _, one := range stored {
+		if err := w.resume(one); err != nil {
+			log.Debug().Err(err).Str("name", one.Name).Str("domain", one.Domain).Msg("dropping pending invoice")
+			DeletePendingInvoice(one.PaymentHash)
+		}
+	}
+
+	log.Debug().Int("count", len(stored)).Msg("resumed pending invoices")
+}
+
+func (w *invoiceWatcher) resume(stored StoredInvoice) error {
+	params, err := GetName(stored.Name, stored.Domain)
+	if err != nil {
+		return err
+	}
+
+	inv, err := newPendingInvoice(stored.PayValues, params)
+	if err != nil {
+		return err
+	}
+
+	if time.Now().Unix() < stored.ExpiresAt {
+		w.add(inv)
+	} else {
+		go w.checkOnce(inv)
+	}
+	return nil
+}
+
+func newPendingInvoice(payvalues LNURLPayValuesCustom, params *Params) (*pendingInvoice, error) {
+	// always follow the invoice on the backend that issued it
+	backend, err := issuingBackend(params, payvalues.Backend, payvalues.BackendID)
+	if err != nil {
+		return nil, err
+	}
+	if !backend.Capabilities().InvoiceLookup {
+		return nil, errLookupUnsupported
+	}
+
+	bolt11, err := decodepay.Decodepay(payvalues.PR)
+	if err != nil {
+		return nil, fmt.Errorf("can't decode invoice to wait for: %w", err)
+	}
+	payvalues.ParsedInvoice = bolt11
+
+	return &pendingInvoice{
+		payvalues: payvalues,
+		params:    params,
+		backend:   backend,
+		bolt11:    bolt11,
+		expiresAt: time.Unix(int64(bolt11.CreatedAt+bolt11.Expiry), 0),
+	}, nil
+}
+
+func (w *invoiceWatcher) add(inv *pendingInvoice) {
+	w.mu.Lock()
+	w.pending[inv.bolt11.PaymentHash] = inv
+	w.mu.Unlock()
+
+	if _, ok := inv.backend.(InvoiceSubscriber); ok {
+		w.subscribe(inv)
+	}
+}
+
+// checkOnce looks up an expired invoice a single time and settles it if it was paid.
+func (w *invoiceWatcher) checkOnce(inv *pendingInvoice) {
+	hash := inv.bolt11.PaymentHash
+
+	status, err := LookupInvoice(inv.backend, hash, inv.payvalues.BackendRef)
+	if err != nil || !status.Paid {
+		DeletePendingInvoice(hash)
+		return
+	}
+
+	w.mu.Lock()
+	w.pending[hash] = inv
+	w.mu.Unlock()
+
+	w.settle(inv, status)
+}
+
+func (w *invoiceWatcher) subscribe(inv *pendingInvoice) {
+	select {
+	case w.subscriptions <- struct{}{}:
+	default:
+		// all subscription slots are taken, this one will be polled
+		return
+	}
+
+	w.mu.Lock()
+	inv.subscribed = true
+	w.mu.Unlock()
+
+	go func() {
+		defer func() { <-w.subscriptions }()
+
+		ctx, cancel := context.WithDeadline(context.Background(), inv.expiresAt)
+		defer cancel()
+
+		status, err := inv.backend.(InvoiceSubscriber).WaitInvoice(ctx, inv.bolt11.PaymentHash)
+		if err == nil && status.Paid {
+			w.settle(inv, status)
+			return
+		}
+		if ctx.Err() == nil {
+			log.Debug().Err(err).Str("payment_hash", inv.bolt11.PaymentHash).Msg("invoice subscription failed, polling instead")
+		}
+
+		// expired invoices are dropped by the scheduler
+		w.mu.Lock()
+		inv.subscribed = false
+		w.mu.Unlock()
+	}()
+}
+
+func (w *invoiceWatcher) schedule() {
+	ticker := time.NewTicker(invoicePollInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		now := time.Now()
+		groups := make(map[string][]*pendingInvoice)
+
+		w.mu.Lock()
+		for hash, inv := range w.pending {
+			if now.After(inv.expiresAt) {
+				log.Debug().Str("NIP57 wait for payment", hash).Msg("Invoice expired")
+				delete(w.pending, hash)
+				DeletePendingInvoice(hash)
+				continue
+			}
+			if inv.subscribed {
+				continue
+			}
+
+			key := backendKey(inv.backend)
+			if w.inFlight[key] {
+				continue
+			}
+			groups[key] = append(groups[key], inv)
+		}
+		for key := range groups {
+			w.inFlight[key] = true
+		}
+		w.mu.Unlock()
+
+		// this blocks while all workers are busy, which slows polling down
+		// instead of piling up work
+		for key, invoices := range groups {
+			w.batches <- invoiceBatch{key, invoices}
+		}
+	}
+}
+
+func (w *invoiceWatcher) work() {
+	for batch := range w.batches {
+		for _, inv := range batch.invoices {
+			status, err := LookupInvoice(inv.backend, inv.bolt11.PaymentHash, inv.payvalues.BackendRef)
+			if err != nil {
+				log.Debug().Err(err).Str("payment_hash", inv.bolt11.PaymentHash).Msg("failed to look up invoice")
+				continue
+			}
+			if status.Paid {
+				w.settle(inv, status)
+			}
+		}
+
+		w.mu.Lock()
+		delete(w.inFlight, batch.key)
+		w.mu.Unlock()
+	}
+}
+
+// settle stops watching a paid invoice and publishes its receipt, unless that
+// was already done by a concurrent subscription or poll.
+func (w *invoiceWatcher) settle(inv *pendingInvoice, status InvoiceStatus) {
+	hash := inv.bolt11.PaymentHash
+
+	w.mu.Lock()
+	if w.pending[hash] != inv {
+		w.mu.Unlock()
+		return
+	}
+	delete(w.pending, hash)
+	w.mu.Unlock()
+
+	inv.payvalues.PaidAt = status.PaidAt
+	inv.payvalues.Paid = true
+	inv.payvalues.MSatoshiReceived = status.MSatoshiReceived
+	// publishing to relays is slow, don't hold up the worker with it.
+	// the stored invoice is only removed afterwards, so a restart in between
+	// publishes the receipt again rather than never
+	go func() {
+		onInvoicePaid(inv.payvalues, inv.params, inv.bolt11)
+		DeletePendingInvoice(hash)
+	}()
+}
+
+// backendKey identifies a backend configuration, so invoices on the same node
+// or account end up in the same batch.
+func backendKey(backend BackendParams) string {
+	return fmt.Sprintf("%T%v", backend, backend)
+}